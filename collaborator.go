@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type LivestreamCollaboratorModel struct {
+	LivestreamID int64 `db:"livestream_id"`
+	UserID       int64 `db:"user_id"`
+}
+
+var (
+	collaboratorLock  sync.RWMutex
+	collaboratorCache = map[int64][]int64{}
+)
+
+func validateCollaboratorIDs(verr *ValidationError, ownerID int64, collaboratorIDs []int64) {
+	seen := map[int64]struct{}{}
+	for _, userID := range collaboratorIDs {
+		if userID == ownerID {
+			verr.Add("collaborators", "owner can't be a collaborator")
+			return
+		}
+		if _, ok := getUserByID(userID); !ok {
+			verr.Add("collaborators", fmt.Sprintf("user %d does not exist", userID))
+			return
+		}
+		if _, ok := seen[userID]; ok {
+			verr.Add("collaborators", fmt.Sprintf("user %d is duplicated", userID))
+			return
+		}
+		seen[userID] = struct{}{}
+	}
+}
+
+func insertLivestreamCollaborators(ctx context.Context, tx *sqlx.Tx, livestreamID int64, collaboratorIDs []int64) error {
+	if len(collaboratorIDs) == 0 {
+		return nil
+	}
+	values := []string{}
+	params := []any{}
+	for _, userID := range collaboratorIDs {
+		values = append(values, "(?, ?)")
+		params = append(params, livestreamID, userID)
+	}
+	query := `INSERT INTO livestream_collaborators (livestream_id, user_id) VALUES ` + strings.Join(values, ", ")
+	_, err := tx.ExecContext(ctx, query, params...)
+	return err
+}
+
+func getCollaboratorIDs(livestreamID int64) []int64 {
+	collaboratorLock.RLock()
+	defer collaboratorLock.RUnlock()
+	return slices.Clone(collaboratorCache[livestreamID])
+}
+
+func setCollaboratorIDs(livestreamID int64, collaboratorIDs []int64) {
+	collaboratorLock.Lock()
+	defer collaboratorLock.Unlock()
+	if len(collaboratorIDs) == 0 {
+		delete(collaboratorCache, livestreamID)
+		return
+	}
+	collaboratorCache[livestreamID] = slices.Clone(collaboratorIDs)
+}
+
+func isCollaborator(livestreamID, userID int64) bool {
+	collaboratorLock.RLock()
+	defer collaboratorLock.RUnlock()
+	return slices.Contains(collaboratorCache[livestreamID], userID)
+}
+
+// 配信者本人かコラボレーターならモデレーションや報告の閲覧ができる
+func canModerateLivestream(livestreamModel LivestreamModel, userID int64) bool {
+	return livestreamModel.UserID == userID || isCollaborator(livestreamModel.ID, userID)
+}
+
+func warmupCollaboratorCache(ctx context.Context) {
+	cCache := map[int64][]int64{}
+	var collaborators []LivestreamCollaboratorModel
+	if err := dbConn.SelectContext(ctx, &collaborators, "SELECT livestream_id, user_id FROM livestream_collaborators ORDER BY livestream_id, user_id"); err != nil {
+		return
+	}
+	for _, c := range collaborators {
+		cCache[c.LivestreamID] = append(cCache[c.LivestreamID], c.UserID)
+	}
+	collaboratorLock.Lock()
+	collaboratorCache = cCache
+	collaboratorLock.Unlock()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type FollowModel struct {
+	FollowerID int64 `db:"follower_id"`
+	FolloweeID int64 `db:"followee_id"`
+	CreatedAt  int64 `db:"created_at"`
+}
+
+var (
+	// フォロー・フォロー解除を1つずつ通す。DBを待つ間も followLock の読み手は止めない
+	followUpdateLock sync.Mutex
+	followLock       sync.RWMutex
+	// フォローしているユーザーID -> フォローされているユーザーIDの集合
+	followingCache     = map[int64]map[int64]struct{}{}
+	followerCountCache = map[int64]int64{}
+)
+
+func isFollowing(followerID, followeeID int64) bool {
+	followLock.RLock()
+	defer followLock.RUnlock()
+	_, ok := followingCache[followerID][followeeID]
+	return ok
+}
+
+func getFollowerCount(userID int64) int64 {
+	followLock.RLock()
+	defer followLock.RUnlock()
+	return followerCountCache[userID]
+}
+
+func getFolloweeIDs(userID int64) map[int64]struct{} {
+	followLock.RLock()
+	defer followLock.RUnlock()
+	followees := make(map[int64]struct{}, len(followingCache[userID]))
+	for id := range followingCache[userID] {
+		followees[id] = struct{}{}
+	}
+	return followees
+}
+
+func warmupFollowCache(ctx context.Context) {
+	fCache := map[int64]map[int64]struct{}{}
+	cCache := map[int64]int64{}
+	var follows []FollowModel
+	if err := dbConn.SelectContext(ctx, &follows, "SELECT * FROM follows"); err != nil {
+		return
+	}
+	for _, f := range follows {
+		if _, ok := fCache[f.FollowerID]; !ok {
+			fCache[f.FollowerID] = map[int64]struct{}{}
+		}
+		fCache[f.FollowerID][f.FolloweeID] = struct{}{}
+		cCache[f.FolloweeID]++
+	}
+	followLock.Lock()
+	followingCache = fCache
+	followerCountCache = cCache
+	followLock.Unlock()
+}
+
+// 配信者のフォローAPI
+// POST /api/user/:username/follow
+func followUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	sess := getSession(c)
+	userID := sess.Values.UserID
+
+	followee, exists := getUserByName(c.Param("username"))
+	if !exists {
+		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+	if followee.ID == userID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't follow yourself")
+	}
+
+	followUpdateLock.Lock()
+	defer followUpdateLock.Unlock()
+
+	if isFollowing(userID, followee.ID) {
+		return c.NoContent(http.StatusNoContent)
+	}
+	if _, err := dbConn.ExecContext(ctx, "INSERT IGNORE INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?)", userID, followee.ID, time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert follow: "+err.Error())
+	}
+
+	followLock.Lock()
+	defer followLock.Unlock()
+	if _, ok := followingCache[userID]; !ok {
+		followingCache[userID] = map[int64]struct{}{}
+	}
+	followingCache[userID][followee.ID] = struct{}{}
+	followerCountCache[followee.ID]++
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 配信者のフォロー解除API
+// DELETE /api/user/:username/follow
+func unfollowUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	sess := getSession(c)
+	userID := sess.Values.UserID
+
+	followee, exists := getUserByName(c.Param("username"))
+	if !exists {
+		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+
+	followUpdateLock.Lock()
+	defer followUpdateLock.Unlock()
+
+	if !isFollowing(userID, followee.ID) {
+		return c.NoContent(http.StatusNoContent)
+	}
+	if _, err := dbConn.ExecContext(ctx, "DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", userID, followee.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete follow: "+err.Error())
+	}
+
+	followLock.Lock()
+	defer followLock.Unlock()
+	delete(followingCache[userID], followee.ID)
+	followerCountCache[followee.ID]--
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// フォロー中の配信者の配信中・配信予定の配信を開始時刻順に返す
+// GET /api/livestream/following
+func getFollowingLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	sess := getSession(c)
+	userID := sess.Values.UserID
+
+	followees := getFolloweeIDs(userID)
+	now := time.Now().Unix()
+	livestreamModels := []LivestreamModel{}
+	userIDs := []int64{}
+	if len(followees) > 0 {
+		for _, l := range searchLivestreams(LivestreamSearchQuery{}) {
+			if _, ok := followees[l.UserID]; !ok || livestreamStatus(l, now) == livestreamStatusEnded {
+				continue
+			}
+			livestreamModels = append(livestreamModels, l)
+			userIDs = append(userIDs, l.UserID)
+		}
+	}
+	sort.SliceStable(livestreamModels, func(i, j int) bool {
+		return livestreamModels[i].StartAt < livestreamModels[j].StartAt
+	})
+
+	userMap, err := getUserMap(ctx, dbConn, userIDs)
+	if err != nil {
+		return err
+	}
+	livestreams := make([]Livestream, len(livestreamModels))
+	for i := range livestreamModels {
+		livestream, err := fillLivestreamResponse(ctx, dbConn, livestreamModels[i], userMap)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestreams[i] = livestream
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
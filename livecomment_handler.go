@@ -1,11 +1,12 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,6 +21,13 @@ var (
 	ngwordCache map[int64][]NGWord
 )
 
+// since_id / before_id を付けたときのレスポンス
+type LivecommentPage struct {
+	Livecomments []Livecomment `json:"livecomments"`
+	NewestID     int64         `json:"newest_id"`
+	OldestID     int64         `json:"oldest_id"`
+}
+
 type PostLivecommentRequest struct {
 	Comment string `json:"comment"`
 	Tip     int64  `json:"tip"`
@@ -43,6 +51,35 @@ type Livecomment struct {
 	CreatedAt  int64      `json:"created_at"`
 }
 
+// 配信を埋め込まないライブコメント
+type SlimLivecomment struct {
+	ID           int64  `json:"id"`
+	User         User   `json:"user"`
+	LivestreamID int64  `json:"livestream_id"`
+	Comment      string `json:"comment"`
+	Tip          int64  `json:"tip"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// embed=none のときのレスポンス
+type SlimLivecommentPage struct {
+	Livestream   Livestream        `json:"livestream"`
+	Livecomments []SlimLivecomment `json:"livecomments"`
+	NewestID     int64             `json:"newest_id"`
+	OldestID     int64             `json:"oldest_id"`
+}
+
+func (l Livecomment) slim() SlimLivecomment {
+	return SlimLivecomment{
+		ID:           l.ID,
+		User:         l.User,
+		LivestreamID: l.Livestream.ID,
+		Comment:      l.Comment,
+		Tip:          l.Tip,
+		CreatedAt:    l.CreatedAt,
+	}
+}
+
 type LivecommentReport struct {
 	ID          int64       `json:"id"`
 	Reporter    User        `json:"reporter"`
@@ -58,8 +95,34 @@ type LivecommentReportModel struct {
 	CreatedAt     int64 `db:"created_at"`
 }
 
+const (
+	// 登録した配信のコメントだけを消す
+	moderateScopeLivestream = "livestream"
+	// 配信者の全ての配信にNGワードを登録し、コメントを消す
+	moderateScopeStreamer = "streamer"
+)
+
+// 配信者の全ての配信に効くNGワードは livestream_id を0で登録する
+const streamerNGWordLivestreamID = 0
+
 type ModerateRequest struct {
 	NGWord string `json:"ng_word"`
+	// 省略時は livestream
+	Scope string `json:"scope"`
+}
+
+// NGワードの登録で消したライブコメントの監査ログ
+type LivecommentDeletionLogModel struct {
+	ID            int64  `db:"id"`
+	LivecommentID int64  `db:"livecomment_id"`
+	LivestreamID  int64  `db:"livestream_id"`
+	UserID        int64  `db:"user_id"`
+	Comment       string `db:"comment"`
+	Tip           int64  `db:"tip"`
+	CommentedAt   int64  `db:"commented_at"`
+	NGWordID      int64  `db:"ng_word_id"`
+	DeletedBy     int64  `db:"deleted_by"`
+	DeletedAt     int64  `db:"deleted_at"`
 }
 
 type NGWord struct {
@@ -83,52 +146,94 @@ func getLivecommentsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	query := "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY id DESC"
-	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
-		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
+	livestreamModel, exists := getLivestreamByID(int64(livestreamID))
+	if !exists {
+		return errLivestreamNotFound(int64(livestreamID))
 	}
 
-	livecommentModels := []LivecommentModel{}
-	err = dbConn.SelectContext(ctx, &livecommentModels, query, livestreamID)
-	if errors.Is(err, sql.ErrNoRows) {
-		return c.JSON(http.StatusOK, []*Livecomment{})
+	window, err := parseIDWindowParams(c)
+	if err != nil {
+		return err
 	}
+	embedLivestream, err := parseEmbedLivestream(c)
+	if err != nil {
+		return err
+	}
+
+	// 配信中の配信は直近のコメントをメモリから返す
+	livecommentModels, ok, err := recentLivecomments.Window(ctx, livestreamModel, window)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 	}
-	livestreamModel, exists := getLivestreamByID(int64(livestreamID))
-	if !exists {
-		return fmt.Errorf("livestream %d not found", livestreamID)
+	if !ok {
+		query, args, ascending := window.query("livecomments", livestreamModel.ID)
+		livecommentModels = []LivecommentModel{}
+		err = dbConn.SelectContext(ctx, &livecommentModels, query, args...)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+		}
+		if ascending {
+			slices.Reverse(livecommentModels)
+		}
+	}
+
+	livestream, livecomments, err := fillLivecomments(ctx, livestreamModel, livecommentModels)
+	if err != nil {
+		return err
+	}
+
+	if embedLivestream && !window.Windowed {
+		return c.JSON(http.StatusOK, livecomments)
 	}
+	ids := make([]int64, len(livecommentModels))
+	for i := range livecommentModels {
+		ids[i] = livecommentModels[i].ID
+	}
+	newestID, oldestID := window.bounds(ids)
+	if !embedLivestream {
+		slimLivecomments := make([]SlimLivecomment, len(livecomments))
+		for i := range livecomments {
+			slimLivecomments[i] = livecomments[i].slim()
+		}
+		return c.JSON(http.StatusOK, &SlimLivecommentPage{
+			Livestream:   livestream,
+			Livecomments: slimLivecomments,
+			NewestID:     newestID,
+			OldestID:     oldestID,
+		})
+	}
+	return c.JSON(http.StatusOK, &LivecommentPage{
+		Livecomments: livecomments,
+		NewestID:     newestID,
+		OldestID:     oldestID,
+	})
+}
 
+// 同じ配信のライブコメントをまとめてレスポンスの形にする
+func fillLivecomments(ctx context.Context, livestreamModel LivestreamModel, livecommentModels []LivecommentModel) (Livestream, []Livecomment, error) {
 	userIDs := []int64{livestreamModel.UserID}
 	for i := range livecommentModels {
 		userIDs = append(userIDs, livecommentModels[i].UserID)
 	}
 	userMap, err := getUserMap(ctx, dbConn, userIDs)
 	if err != nil {
-		return err
+		return Livestream{}, nil, err
 	}
 
 	livestream, err := fillLivestreamResponse(ctx, dbConn, livestreamModel, userMap)
 	if err != nil {
-		return err
+		return Livestream{}, nil, err
 	}
 	livecomments := make([]Livecomment, len(livecommentModels))
 	for i := range livecommentModels {
 		livecomment, err := fillLivecommentResponse(ctx, dbConn, livecommentModels[i], livestream, userMap)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fil livecomments: "+err.Error())
+			return Livestream{}, nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to fil livecomments: "+err.Error())
 		}
 
 		livecomments[i] = livecomment
 	}
-
-	return c.JSON(http.StatusOK, livecomments)
+	return livestream, livecomments, nil
 }
 
 func getNgwords(c echo.Context) error {
@@ -146,7 +251,17 @@ func getNgwords(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	ngWords := getNGWordsByLivestreamIDUserID(int64(livestreamID), userID)
+	livestreamModel, exists := getLivestreamByID(int64(livestreamID))
+	if !exists {
+		return errLivestreamNotFound(int64(livestreamID))
+	}
+
+	// コラボレーターには配信者が登録したNGワードを返す
+	ownerID := userID
+	if canModerateLivestream(livestreamModel, userID) {
+		ownerID = livestreamModel.UserID
+	}
+	ngWords := getNGWordsByLivestreamIDUserID(int64(livestreamID), ownerID)
 
 	return c.JSON(http.StatusOK, ngWords)
 }
@@ -172,15 +287,29 @@ func postLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
+	livecomment, err := createLivecomment(ctx, userID, int64(livestreamID), req)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, livecomment)
+}
+
+// NGワードを確かめてライブコメントを登録し、配信の購読者に流す
+// WebSocket からの投稿でも使う
+func createLivecomment(ctx context.Context, userID, livestreamID int64, req *PostLivecommentRequest) (Livecomment, error) {
 	tx, err := dbConn.BeginTxx(ctx, nil) // post
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	livestreamModel, exists := getLivestreamByID(int64(livestreamID))
+	livestreamModel, exists := getLivestreamByID(livestreamID)
 	if !exists {
-		return fmt.Errorf("livestream %d not found", livestreamID)
+		return Livecomment{}, errLivestreamNotFound(livestreamID)
+	}
+	if err := livestreamStatusConfig.checkOpen(livestreamModel, time.Now()); err != nil {
+		return Livecomment{}, err
 	}
 
 	// スパム判定
@@ -191,16 +320,15 @@ func postLivecommentHandler(c echo.Context) error {
 		if strings.Contains(req.Comment, ngword.Word) {
 			hitSpam++
 		}
-		c.Logger().Infof("[hitSpam=%d] comment = %s", hitSpam, req.Comment)
 		if hitSpam >= 1 {
-			return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
+			return Livecomment{}, echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
 		}
 	}
 
 	now := time.Now().Unix()
 	livecommentModel := LivecommentModel{
 		UserID:       userID,
-		LivestreamID: int64(livestreamID),
+		LivestreamID: livestreamID,
 		Comment:      req.Comment,
 		Tip:          req.Tip,
 		CreatedAt:    now,
@@ -208,33 +336,40 @@ func postLivecommentHandler(c echo.Context) error {
 
 	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (:user_id, :livestream_id, :comment, :tip, :created_at)", livecommentModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment: "+err.Error())
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment: "+err.Error())
 	}
 
 	livecommentID, err := rs.LastInsertId()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment id: "+err.Error())
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment id: "+err.Error())
 	}
 	livecommentModel.ID = livecommentID
 
 	userMap, err := getUserMap(ctx, tx, []int64{livestreamModel.UserID, livecommentModel.UserID})
 	if err != nil {
-		return err
+		return Livecomment{}, err
 	}
 	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel, userMap)
 	if err != nil {
-		return err
+		return Livecomment{}, err
 	}
 	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel, livestream, userMap)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusCreated, livecomment)
+	recentLivecomments.Append(livestreamModel, livecommentModel)
+	livestreamEvents.Publish(livestreamID, LivestreamEvent{
+		ID:   livecomment.ID,
+		Type: livestreamEventLivecomment,
+		Data: livecomment,
+	})
+
+	return livecomment, nil
 }
 
 func reportLivecommentHandler(c echo.Context) error {
@@ -257,6 +392,10 @@ func reportLivecommentHandler(c echo.Context) error {
 	sess := getSession(c)
 	userID := sess.Values.UserID
 
+	if _, exists := getLivestreamByID(int64(livestreamID)); !exists {
+		return errLivestreamNotFound(int64(livestreamID))
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil) // post
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -328,21 +467,36 @@ func moderateHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	// 配信者自身の配信に対するmoderateなのかを検証
-	var ownedLivestreams []LivestreamModel
-	if err := tx.SelectContext(ctx, &ownedLivestreams, "SELECT id FROM livestreams WHERE id = ? AND user_id = ?", livestreamID, userID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	// 配信者自身かコラボレーターによるmoderateなのかを検証
+	livestreamModel, exists := getLivestreamByID(int64(livestreamID))
+	if !exists {
+		return errLivestreamNotFound(int64(livestreamID))
 	}
-	if len(ownedLivestreams) == 0 {
+	if !canModerateLivestream(livestreamModel, userID) {
 		return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
 	}
+	switch req.Scope {
+	case "", moderateScopeLivestream:
+	case moderateScopeStreamer:
+		// 他の配信にまで及ぶので配信者本人に限る
+		if livestreamModel.UserID != userID {
+			return newForbiddenError("only the owner can moderate all livestreams of the streamer")
+		}
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "scope must be livestream or streamer")
+	}
 
+	// コラボレーターが登録したNGワードも配信者のものとして扱う
 	ngword := NGWord{
-		UserID:       int64(userID),
+		UserID:       livestreamModel.UserID,
 		LivestreamID: int64(livestreamID),
 		Word:         req.NGWord,
 		CreatedAt:    time.Now().Unix(),
 	}
+	// streamer なら livestream_id を0にして、これから予約する配信も含めた配信者の全ての配信に効かせる
+	if req.Scope == moderateScopeStreamer {
+		ngword.LivestreamID = streamerNGWordLivestreamID
+	}
 	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", ngword)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new NG word: "+err.Error())
@@ -354,8 +508,42 @@ func moderateHandler(c echo.Context) error {
 	}
 	ngword.ID = wordID
 
-	if _, err := tx.ExecContext(ctx, `DELETE FROM livecomments WHERE INSTR(comment, ?) > 0`, ngword.Word); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
+	// 監査ログと購読者への通知のために、消すコメントを先に引いておく
+	scopeCondition, scopeArg := "livestream_id = ?", livestreamModel.ID
+	if req.Scope == moderateScopeStreamer {
+		scopeCondition, scopeArg = "livestream_id IN (SELECT id FROM livestreams WHERE user_id = ?)", livestreamModel.UserID
+	}
+	var deletedLivecomments []LivecommentModel
+	if err := tx.SelectContext(ctx, &deletedLivecomments, "SELECT * FROM livecomments WHERE "+scopeCondition+" AND INSTR(comment, ?) > 0 FOR UPDATE", scopeArg, ngword.Word); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments that hit spams: "+err.Error())
+	}
+	if len(deletedLivecomments) > 0 {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM livecomments WHERE "+scopeCondition+" AND INSTR(comment, ?) > 0", scopeArg, ngword.Word); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
+		}
+
+		deletedAt := time.Now().Unix()
+		logs := make([]LivecommentDeletionLogModel, len(deletedLivecomments))
+		for i, l := range deletedLivecomments {
+			logs[i] = LivecommentDeletionLogModel{
+				LivecommentID: l.ID,
+				LivestreamID:  l.LivestreamID,
+				UserID:        l.UserID,
+				Comment:       l.Comment,
+				Tip:           l.Tip,
+				CommentedAt:   l.CreatedAt,
+				NGWordID:      wordID,
+				DeletedBy:     userID,
+				DeletedAt:     deletedAt,
+			}
+		}
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livecomment_deletion_logs (livecomment_id, livestream_id, user_id, comment, tip, commented_at, ng_word_id, deleted_by, deleted_at) VALUES (:livecomment_id, :livestream_id, :user_id, :comment, :tip, :commented_at, :ng_word_id, :deleted_by, :deleted_at)", logs); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment deletion logs: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
 	ngwordLock.Lock()
@@ -367,13 +555,13 @@ func moderateHandler(c echo.Context) error {
 	}
 	ngwordLock.Unlock()
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
+	recentLivecomments.Remove(deletedLivecomments)
+	publishLivecommentDeletions(deletedLivecomments)
 	time.Sleep(3 * time.Second)
 
 	return c.JSON(http.StatusCreated, map[string]interface{}{
-		"word_id": wordID,
+		"word_id":              wordID,
+		"deleted_livecomments": len(deletedLivecomments),
 	})
 }
 
@@ -418,7 +606,7 @@ func fillLivecommentReportResponse(ctx context.Context, tx dbtx, reportModel Liv
 
 	livestreamModel, exists := getLivestreamByID(livecommentModel.LivestreamID)
 	if !exists {
-		return LivecommentReport{}, fmt.Errorf("livestream %d not found", livecommentModel.LivestreamID)
+		return LivecommentReport{}, errLivestreamNotFound(livecommentModel.LivestreamID)
 	}
 
 	userMap, err := getUserMap(ctx, tx, []int64{livecommentModel.UserID, livestreamModel.UserID})
@@ -474,5 +662,18 @@ func getNGWordsByLivestreamIDUserID(livestreamID, userID int64) []NGWord {
 			}
 		}
 	}
+	// 配信者の全ての配信に効くNGワード
+	streamerWords := false
+	for _, n := range ngwordCache[streamerNGWordLivestreamID] {
+		if n.UserID == userID {
+			r = append(r, n)
+			streamerWords = true
+		}
+	}
+	if streamerWords {
+		slices.SortFunc(r, func(a, b NGWord) int {
+			return cmp.Compare(b.ID, a.ID)
+		})
+	}
 	return r
 }
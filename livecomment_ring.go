@@ -0,0 +1,177 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// 配信ごとに保持する直近のライブコメント数
+const livecommentRingSize = 1000
+
+// 配信中の配信の直近のライブコメント
+// items は ID の昇順。floor 以上の ID のコメントは漏れなく持っている (0 なら全て)
+type livecommentRing struct {
+	items []LivecommentModel
+	floor int64
+}
+
+type livecommentRingStore struct {
+	mu    sync.Mutex
+	rings map[int64]*livecommentRing
+	// 削除のたびに進める。読み込み中に削除があったら読み込んだ結果を捨てる
+	generation uint64
+}
+
+var recentLivecomments = &livecommentRingStore{
+	rings: map[int64]*livecommentRing{},
+}
+
+func (r *livecommentRing) insert(l LivecommentModel) {
+	i, found := slices.BinarySearchFunc(r.items, l.ID, func(item LivecommentModel, id int64) int {
+		return cmp.Compare(item.ID, id)
+	})
+	if found {
+		return
+	}
+	r.items = slices.Insert(r.items, i, l)
+	if len(r.items) > livecommentRingSize {
+		r.items = slices.Delete(r.items, 0, len(r.items)-livecommentRingSize)
+		r.floor = max(r.floor, r.items[0].ID)
+	}
+}
+
+// window に当てはまるコメントを ID の降順で返す。持っている範囲で答えられなければ false
+func (r *livecommentRing) window(p idWindowParams) ([]LivecommentModel, bool) {
+	matched := []LivecommentModel{}
+	for i := len(r.items) - 1; i >= 0; i-- {
+		l := r.items[i]
+		if l.ID < r.floor || l.ID <= p.SinceID {
+			break
+		}
+		if p.BeforeID > 0 && l.ID >= p.BeforeID {
+			continue
+		}
+		matched = append(matched, l)
+	}
+	// since_id より後が全て floor 以上なら、持っているものが答えそのもの
+	if r.floor == 0 || p.SinceID >= r.floor-1 {
+		if p.Limit >= 0 && len(matched) > p.Limit {
+			if p.ascending() {
+				return matched[len(matched)-p.Limit:], true
+			}
+			return matched[:p.Limit], true
+		}
+		return matched, true
+	}
+	// 新しい方から limit 件取るなら、limit 件以上持っていれば足りる
+	if !p.ascending() && p.Limit >= 0 && len(matched) >= p.Limit {
+		return matched[:p.Limit], true
+	}
+	return nil, false
+}
+
+func isLivecommentRingActive(livestreamModel LivestreamModel) bool {
+	return livestreamStatus(livestreamModel, time.Now().Unix()) != livestreamStatusEnded
+}
+
+// 投稿されたコメントを足す。まだリングがなければ、このコメントから先を持つリングを作る
+func (s *livecommentRingStore) Append(livestreamModel LivestreamModel, l LivecommentModel) {
+	if !isLivecommentRingActive(livestreamModel) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rings[l.LivestreamID]
+	if !ok {
+		r = &livecommentRing{floor: l.ID}
+		s.rings[l.LivestreamID] = r
+	}
+	r.insert(l)
+}
+
+// モデレーションなどで消したコメントを外す
+func (s *livecommentRingStore) Remove(livecommentModels []LivecommentModel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	for _, l := range livecommentModels {
+		r, ok := s.rings[l.LivestreamID]
+		if !ok {
+			continue
+		}
+		r.items = slices.DeleteFunc(r.items, func(item LivecommentModel) bool {
+			return item.ID == l.ID
+		})
+	}
+}
+
+func (s *livecommentRingStore) Drop(livestreamID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	delete(s.rings, livestreamID)
+}
+
+func (s *livecommentRingStore) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	s.rings = map[int64]*livecommentRing{}
+}
+
+// リングで答えられる問い合わせならMySQLを引かずに返す
+// 答えられなければ直近のコメントを読み込んでから、もう一度試す
+func (s *livecommentRingStore) Window(ctx context.Context, livestreamModel LivestreamModel, p idWindowParams) ([]LivecommentModel, bool, error) {
+	if !isLivecommentRingActive(livestreamModel) {
+		// 終わった配信のリングは使わないので捨てる
+		s.mu.Lock()
+		delete(s.rings, livestreamModel.ID)
+		s.mu.Unlock()
+		return nil, false, nil
+	}
+
+	s.mu.Lock()
+	if r, ok := s.rings[livestreamModel.ID]; ok {
+		if livecommentModels, ok := r.window(p); ok {
+			s.mu.Unlock()
+			return livecommentModels, true, nil
+		}
+		// 上限まで持っていて答えられないなら、読み込み直しても同じ
+		if len(r.items) >= livecommentRingSize {
+			s.mu.Unlock()
+			return nil, false, nil
+		}
+	}
+	generation := s.generation
+	s.mu.Unlock()
+
+	livecommentModels := []LivecommentModel{}
+	if err := dbConn.SelectContext(ctx, &livecommentModels, "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY id DESC LIMIT ?", livestreamModel.ID, livecommentRingSize); err != nil {
+		return nil, false, err
+	}
+	// 上限まで取れなければ全てのコメントを持っている
+	floor := int64(0)
+	if len(livecommentModels) == livecommentRingSize {
+		floor = livecommentModels[len(livecommentModels)-1].ID
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.generation != generation {
+		return nil, false, nil
+	}
+	r, ok := s.rings[livestreamModel.ID]
+	if !ok {
+		r = &livecommentRing{floor: floor}
+		s.rings[livestreamModel.ID] = r
+	}
+	r.floor = min(r.floor, floor)
+	for _, l := range livecommentModels {
+		r.insert(l)
+	}
+	window, ok := r.window(p)
+	return window, ok, nil
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"fmt"
-	"math"
 	"net/http"
 	"strconv"
 	"strings"
@@ -11,6 +10,7 @@ import (
 	"time"
 
 	"github.com/goccy/go-json"
+	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 )
 
@@ -22,6 +22,28 @@ type ReserveLivestreamRequest struct {
 	ThumbnailUrl string  `json:"thumbnail_url"`
 	StartAt      int64   `json:"start_at"`
 	EndAt        int64   `json:"end_at"`
+	// 繰り返し予約
+	Recurrence *RecurrenceRule `json:"recurrence,omitempty"`
+	// 繰り返し予約で一部の回が予約できなくても、予約できた回だけを登録する
+	AllowPartial bool `json:"allow_partial"`
+	// 予約枠が埋まっていたら空き待ちに並ぶ
+	Waitlist bool `json:"waitlist"`
+	// 一緒に配信するユーザーのID。モデレーションと報告の閲覧ができる
+	Collaborators []int64 `json:"collaborators"`
+}
+
+type RescheduleLivestreamRequest struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+}
+
+// 指定されたフィールドだけを更新する
+type UpdateLivestreamRequest struct {
+	Title        *string  `json:"title"`
+	Description  *string  `json:"description"`
+	PlaylistUrl  *string  `json:"playlist_url"`
+	ThumbnailUrl *string  `json:"thumbnail_url"`
+	Tags         *[]int64 `json:"tags"`
 }
 
 type LivestreamViewerModel struct {
@@ -40,18 +62,32 @@ type LivestreamModel struct {
 	StartAt      int64  `db:"start_at" json:"start_at"`
 	EndAt        int64  `db:"end_at" json:"end_at"`
 	RawTags      string `db:"raw_tags"`
+	SeriesID     int64  `db:"series_id" json:"series_id"`
 }
 
 type Livestream struct {
-	ID           int64  `json:"id"`
-	Owner        User   `json:"owner"`
-	Title        string `json:"title"`
-	Description  string `json:"description"`
-	PlaylistUrl  string `json:"playlist_url"`
-	ThumbnailUrl string `json:"thumbnail_url"`
-	Tags         []Tag  `json:"tags"`
-	StartAt      int64  `json:"start_at"`
-	EndAt        int64  `json:"end_at"`
+	ID            int64  `json:"id"`
+	Owner         User   `json:"owner"`
+	Title         string `json:"title"`
+	Description   string `json:"description"`
+	PlaylistUrl   string `json:"playlist_url"`
+	ThumbnailUrl  string `json:"thumbnail_url"`
+	Tags          []Tag  `json:"tags"`
+	StartAt       int64  `json:"start_at"`
+	EndAt         int64  `json:"end_at"`
+	SeriesID      int64  `json:"series_id,omitempty"`
+	Collaborators []User `json:"collaborators"`
+	// upcoming, live, ended
+	Status string `json:"status"`
+	// プレイリストの疎通確認で取得できなかった
+	PlaylistUnreachable bool `json:"playlist_unreachable,omitempty"`
+}
+
+type LivestreamSeriesModel struct {
+	ID        int64  `db:"id"`
+	UserID    int64  `db:"user_id"`
+	Rule      string `db:"rule"`
+	CreatedAt int64  `db:"created_at"`
 }
 
 type LivestreamTagModel struct {
@@ -67,22 +103,45 @@ type ReservationSlotModel struct {
 	EndAt   int64 `db:"end_at" json:"end_at"`
 }
 
-var TagMap = map[int64]Tag{}
-var TagIDMap = map[string]int64{}
-var Tags = []string{"ライブ配信", "ゲーム実況", "生放送", "アドバイス", "初心者歓迎", "プロゲーマー", "新作ゲーム", "レトロゲーム", "RPG", "FPS", "アクションゲーム", "対戦ゲーム", "マルチプレイ", "シングルプレイ", "ゲーム解説", "ホラーゲーム", "イベント生放送", "新情報発表", "Q&Aセッション", "チャット交流", "視聴者参加", "音楽ライブ", "カバーソング", "オリジナル楽曲", "アコースティック", "歌配信", "楽器演奏", "ギター", "ピアノ", "バンドセッション", "DJセット", "トーク配信", "朝活", "夜ふかし", "日常話", "趣味の話", "語学学習", "お料理配信", "手料理", "レシピ紹介", "アート配信", "絵描き", "DIY", "手芸", "アニメトーク", "映画レビュー", "読書感想", "ファッション", "メイク", "ビューティー", "健康", "ワークアウト", "ヨガ", "ダンス", "旅行記", "アウトドア", "キャンプ", "ペットと一緒", "猫", "犬", "釣り", "ガーデニング", "テクノロジー", "ガジェット紹介", "プログラミング", "DIY電子工作", "ニュース解説", "歴史", "文化", "社会問題", "心理学", "宇宙", "科学", "マジック", "コメディ", "スポーツ", "サッカー", "野球", "バスケットボール", "ライフハック", "教育", "子育て", "ビジネス", "起業", "投資", "仮想通貨", "株式投資", "不動産", "キャリア", "スピリチュアル", "占い", "手相", "オカルト", "UFO", "都市伝説", "コンサート", "ファンミーティング", "コラボ配信", "記念配信", "生誕祭", "周年記念", "サプライズ", "椅子"}
+type ReservationAvailability struct {
+	StartAt   int64 `json:"start_at"`
+	EndAt     int64 `json:"end_at"`
+	Remaining int64 `json:"remaining"`
+}
+
+type ReservationConflictResponse struct {
+	Error     string                    `json:"error"`
+	FullSlots []ReservationAvailability `json:"full_slots"`
+}
+
+// 繰り返し予約で予約できなかった回
+type ReservationFailure struct {
+	StartAt   int64                     `json:"start_at"`
+	EndAt     int64                     `json:"end_at"`
+	Error     string                    `json:"error"`
+	FullSlots []ReservationAvailability `json:"full_slots,omitempty"`
+}
+
+type ReserveLivestreamSeriesResponse struct {
+	SeriesID    int64                `json:"series_id"`
+	Livestreams []Livestream         `json:"livestreams"`
+	Failures    []ReservationFailure `json:"failures"`
+}
+
+type ReservationSeriesConflictResponse struct {
+	Error    string               `json:"error"`
+	Failures []ReservationFailure `json:"failures"`
+}
+
+const maxAvailabilitySlots = 24 * 31
 
 var (
 	livestreamLock  sync.RWMutex
 	livestreamCache map[int64]LivestreamModel
+	// 予約のキャンセル・変更、配信情報の編集を直列にする
+	livestreamUpdateLock sync.Mutex
 )
 
-func init() {
-	for i, t := range Tags {
-		TagMap[int64(i+1)] = Tag{int64(i + 1), t}
-		TagIDMap[t] = int64(i + 1)
-	}
-}
-
 func reserveLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
@@ -100,43 +159,48 @@ func reserveLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil) // post
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must not be empty")
 	}
-	defer tx.Rollback()
-
-	// 2023/11/25 10:00からの１年間の期間内であるかチェック
-	var (
-		termStartAt    = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
-		termEndAt      = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
-		reserveStartAt = time.Unix(req.StartAt, 0)
-		reserveEndAt   = time.Unix(req.EndAt, 0)
-	)
-	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
-		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	if err := req.validate(time.Now(), userID); err != nil {
+		return err
+	}
+	if req.Recurrence != nil {
+		return reserveLivestreamSeries(c, req, userID)
 	}
 
-	startIndex := math.Ceil(float64(req.StartAt-1700874000) / 3600)
-	endIndex := math.Floor(float64(req.EndAt-1700874000) / 3600)
+	startIndex, endIndex := reservationConfig.slotIDRange(req.StartAt, req.EndAt)
 
 	// 予約枠をみて、予約が可能か調べる
-	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
-	//var slots []*ReservationSlotModel
-	var minslot int64
-	if err := tx.GetContext(ctx, &minslot, "SELECT MIN(slot) FROM reservation_slots WHERE id >= ? AND id <= ? FOR UPDATE", startIndex, endIndex); err != nil {
-		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
-	}
-	if minslot < 1 {
-		return c.NoContent(http.StatusBadRequest)
-		// return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d(%f) ~ %d(%f)が予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, startIndex, req.EndAt, endIndex))
+	// 判定と確保はメモリ上で行い、DBには確保した結果だけを反映する
+	if ok, fullSlots := reservationSlots.Reserve(startIndex, endIndex); !ok {
+		if req.Waitlist && len(fullSlots) > 0 {
+			if err := validateReservationWaitlist(req, time.Now()); err != nil {
+				return err
+			}
+			entry, err := enqueueReservationWaitlist(ctx, userID, req)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reservation waitlist: "+err.Error())
+			}
+			return c.JSON(http.StatusAccepted, entry)
+		}
+		return c.JSON(http.StatusBadRequest, &ReservationConflictResponse{
+			Error:     "reservation slots are full",
+			FullSlots: toReservationAvailabilities(fullSlots),
+		})
 	}
+	committed := false
+	defer func() {
+		if !committed {
+			reservationSlots.Release(startIndex, endIndex)
+		}
+	}()
 
-	tagIDs := []string{}
-	for _, tagID := range req.Tags {
-		tagIDs = append(tagIDs, strconv.Itoa(int(tagID)))
+	tx, err := dbConn.BeginTxx(ctx, nil) // post
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
+	defer tx.Rollback()
 
 	var (
 		livestreamModel = &LivestreamModel{
@@ -147,15 +211,42 @@ func reserveLivestreamHandler(c echo.Context) error {
 			ThumbnailUrl: req.ThumbnailUrl,
 			StartAt:      req.StartAt,
 			EndAt:        req.EndAt,
-			RawTags:      strings.Join(tagIDs, ","),
+			RawTags:      formatRawTags(req.Tags),
 		}
 	)
 
+	if err := insertLivestream(ctx, tx, livestreamModel, req.Tags, req.Collaborators); err != nil {
+		return err
+	}
+
+	userMap, err := getUserMap(ctx, tx, []int64{userID})
+	if err != nil {
+		return err
+	}
+	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel, userMap)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	committed = true
+
+	setLivestreamCache(*livestreamModel)
+	setCollaboratorIDs(livestreamModel.ID, req.Collaborators)
+
+	return c.JSON(http.StatusCreated, livestream)
+}
+
+// 確保済みの予約枠をDBに反映し、配信とタグ、コラボレーターを登録する
+func insertLivestream(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, tagIDs []int64, collaboratorIDs []int64) error {
+	startIndex, endIndex := reservationConfig.slotIDRange(livestreamModel.StartAt, livestreamModel.EndAt)
 	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE id >= ? AND id <= ?", startIndex, endIndex); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
 	}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at, raw_tags) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at, :raw_tags)", livestreamModel)
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at, raw_tags, series_id) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at, :raw_tags, :series_id)", livestreamModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
 	}
@@ -167,16 +258,243 @@ func reserveLivestreamHandler(c echo.Context) error {
 	livestreamModel.ID = livestreamID
 
 	// タグ追加
-	if len(req.Tags) > 0 {
-		values := []string{}
-		params := []any{}
-		for _, tagID := range req.Tags {
-			values = append(values, "(?, ?)")
-			params = append(params, livestreamID, tagID)
+	if err := insertLivestreamTags(ctx, tx, livestreamID, tagIDs); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tags: "+err.Error())
+	}
+	if err := insertLivestreamCollaborators(ctx, tx, livestreamID, collaboratorIDs); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert collaborators: "+err.Error())
+	}
+	return nil
+}
+
+// 繰り返し予約
+// 全ての回の予約枠をまとめて確保し、同じ series_id を持つ配信として登録する
+func reserveLivestreamSeries(c echo.Context, req *ReserveLivestreamRequest, userID int64) error {
+	ctx := c.Request().Context()
+
+	occurrences := req.Recurrence.occurrences(req.StartAt, req.EndAt)
+	failures := []ReservationFailure{}
+
+	// 予約期間外の回は枠を確保せずに失敗扱いにする
+	candidates := []Occurrence{}
+	ranges := []slotRange{}
+	for _, o := range occurrences {
+		if !reservationConfig.inTerm(o.StartAt, o.EndAt) {
+			failures = append(failures, ReservationFailure{StartAt: o.StartAt, EndAt: o.EndAt, Error: "bad reservation time range"})
+			continue
+		}
+		startIndex, endIndex := reservationConfig.slotIDRange(o.StartAt, o.EndAt)
+		candidates = append(candidates, o)
+		ranges = append(ranges, slotRange{StartID: startIndex, EndID: endIndex})
+	}
+	if len(failures) > 0 && !req.AllowPartial {
+		return c.JSON(http.StatusBadRequest, &ReservationSeriesConflictResponse{
+			Error:    "some occurrences can't be reserved",
+			Failures: failures,
+		})
+	}
+
+	results := reservationSlots.ReserveEach(ranges, !req.AllowPartial)
+	reserved := []Occurrence{}
+	reservedRanges := []slotRange{}
+	for i, r := range results {
+		if r.OK {
+			reserved = append(reserved, candidates[i])
+			reservedRanges = append(reservedRanges, ranges[i])
+			continue
+		}
+		failures = append(failures, ReservationFailure{
+			StartAt:   candidates[i].StartAt,
+			EndAt:     candidates[i].EndAt,
+			Error:     "reservation slots are full",
+			FullSlots: toReservationAvailabilities(r.FullSlots),
+		})
+	}
+	if len(reserved) == 0 {
+		return c.JSON(http.StatusBadRequest, &ReservationSeriesConflictResponse{
+			Error:    "no occurrence can be reserved",
+			Failures: failures,
+		})
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			for _, r := range reservedRanges {
+				reservationSlots.Release(r.StartID, r.EndID)
+			}
+		}
+	}()
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	rule, err := json.Marshal(req.Recurrence)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to encode recurrence rule: "+err.Error())
+	}
+	seriesModel := LivestreamSeriesModel{
+		UserID:    userID,
+		Rule:      string(rule),
+		CreatedAt: time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_series (user_id, rule, created_at) VALUES (:user_id, :rule, :created_at)", seriesModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream series: "+err.Error())
+	}
+	seriesID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream series id: "+err.Error())
+	}
+
+	userMap, err := getUserMap(ctx, tx, []int64{userID})
+	if err != nil {
+		return err
+	}
+	livestreamModels := make([]LivestreamModel, len(reserved))
+	livestreams := make([]Livestream, len(reserved))
+	for i, o := range reserved {
+		livestreamModels[i] = LivestreamModel{
+			UserID:       userID,
+			Title:        req.Title,
+			Description:  req.Description,
+			PlaylistUrl:  req.PlaylistUrl,
+			ThumbnailUrl: req.ThumbnailUrl,
+			StartAt:      o.StartAt,
+			EndAt:        o.EndAt,
+			RawTags:      formatRawTags(req.Tags),
+			SeriesID:     seriesID,
 		}
-		query := `INSERT INTO livestream_tags (livestream_id, tag_id) VALUES ` + strings.Join(values, ", ")
-		_, err = tx.ExecContext(ctx, query, params...)
+		if err := insertLivestream(ctx, tx, &livestreamModels[i], req.Tags, req.Collaborators); err != nil {
+			return err
+		}
+		livestream, err := fillLivestreamResponse(ctx, tx, livestreamModels[i], userMap)
 		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestreams[i] = livestream
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	committed = true
+
+	setLivestreamCache(livestreamModels...)
+	for _, l := range livestreamModels {
+		setCollaboratorIDs(l.ID, req.Collaborators)
+	}
+
+	return c.JSON(http.StatusCreated, &ReserveLivestreamSeriesResponse{
+		SeriesID:    seriesID,
+		Livestreams: livestreams,
+		Failures:    failures,
+	})
+}
+
+func formatRawTags(tagIDs []int64) string {
+	rawTags := make([]string, len(tagIDs))
+	for i, tagID := range tagIDs {
+		rawTags[i] = strconv.FormatInt(tagID, 10)
+	}
+	return strings.Join(rawTags, ",")
+}
+
+func insertLivestreamTags(ctx context.Context, tx *sqlx.Tx, livestreamID int64, tagIDs []int64) error {
+	if len(tagIDs) == 0 {
+		return nil
+	}
+	values := []string{}
+	params := []any{}
+	for _, tagID := range tagIDs {
+		values = append(values, "(?, ?)")
+		params = append(params, livestreamID, tagID)
+	}
+	query := `INSERT INTO livestream_tags (livestream_id, tag_id) VALUES ` + strings.Join(values, ", ")
+	_, err := tx.ExecContext(ctx, query, params...)
+	return err
+}
+
+// 配信情報の編集API
+// PATCH /api/livestream/:livestream_id
+func updateLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	sess := getSession(c)
+	userID := sess.Values.UserID
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req *UpdateLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	verr := &ValidationError{}
+	if req.Tags != nil {
+		validateTagIDs(verr, *req.Tags)
+	}
+	if req.PlaylistUrl != nil {
+		mediaURLConfig.validatePlaylistURL(verr, *req.PlaylistUrl)
+	}
+	if req.ThumbnailUrl != nil {
+		mediaURLConfig.validateThumbnailURL(verr, *req.ThumbnailUrl)
+	}
+	if err := verr.Err(); err != nil {
+		return err
+	}
+
+	livestreamUpdateLock.Lock()
+	defer livestreamUpdateLock.Unlock()
+
+	livestreamModel, exists := getLivestreamByID(int64(livestreamID))
+	if !exists {
+		return errLivestreamNotFound(int64(livestreamID))
+	}
+	if livestreamModel.UserID != userID {
+		return newForbiddenError("can't edit other streamer's livestream")
+	}
+
+	if req.Title != nil {
+		livestreamModel.Title = *req.Title
+	}
+	if req.Description != nil {
+		livestreamModel.Description = *req.Description
+	}
+	if req.PlaylistUrl != nil {
+		livestreamModel.PlaylistUrl = *req.PlaylistUrl
+	}
+	if req.ThumbnailUrl != nil {
+		livestreamModel.ThumbnailUrl = *req.ThumbnailUrl
+	}
+	if req.Tags != nil {
+		livestreamModel.RawTags = formatRawTags(*req.Tags)
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.NamedExecContext(ctx, "UPDATE livestreams SET title = :title, description = :description, playlist_url = :playlist_url, thumbnail_url = :thumbnail_url, raw_tags = :raw_tags WHERE id = :id", livestreamModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+
+	if req.Tags != nil {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete tags: "+err.Error())
+		}
+		if err := insertLivestreamTags(ctx, tx, livestreamModel.ID, *req.Tags); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tags: "+err.Error())
 		}
 	}
@@ -185,53 +503,297 @@ func reserveLivestreamHandler(c echo.Context) error {
 	if err != nil {
 		return err
 	}
-	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel, userMap)
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel, userMap)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
 
-	livestreamLock.Lock()
-	livestreamCache[livestreamModel.ID] = *livestreamModel
-	livestreamLock.Unlock()
-
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusCreated, livestream)
+	setLivestreamCache(livestreamModel)
+
+	return c.JSON(http.StatusOK, livestream)
 }
 
-func searchLivestreamsHandler(c echo.Context) error {
+// 配信予約のキャンセルAPI
+// DELETE /api/livestream/:livestream_id
+func cancelLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	keyTagName := c.QueryParam("tag")
-
-	var livestreamIDs []int64
-	if c.QueryParam("tag") != "" {
-		// タグによる取得
-		tagID, ok := TagIDMap[keyTagName]
-		if !ok {
-			return c.NoContent(http.StatusNotFound)
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	sess := getSession(c)
+	userID := sess.Values.UserID
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	livestreamUpdateLock.Lock()
+	defer livestreamUpdateLock.Unlock()
+
+	livestreamModel, exists := getLivestreamByID(int64(livestreamID))
+	if !exists {
+		return errLivestreamNotFound(int64(livestreamID))
+	}
+	if livestreamModel.UserID != userID {
+		return newForbiddenError("can't cancel other streamer's livestream")
+	}
+	if err := reservationConfig.checkNotStarted(livestreamModel, time.Now()); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	rs, err := tx.ExecContext(ctx, "DELETE FROM livestreams WHERE id = ? AND user_id = ?", livestreamModel.ID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream: "+err.Error())
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream: "+err.Error())
+	} else if n == 0 {
+		return errLivestreamNotFound(int64(livestreamID))
+	}
+
+	for _, query := range []string{
+		"DELETE FROM livestream_tags WHERE livestream_id = ?",
+		"DELETE FROM livecomment_reports WHERE livestream_id = ?",
+		"DELETE FROM livecomments WHERE livestream_id = ?",
+		"DELETE FROM reactions WHERE livestream_id = ?",
+		"DELETE FROM ng_words WHERE livestream_id = ?",
+		"DELETE FROM livestream_viewers_history WHERE livestream_id = ?",
+		"DELETE FROM livestream_collaborators WHERE livestream_id = ?",
+		// コメント・リアクション削除のトリガーで更新されるので最後に消す
+		"DELETE FROM livestream_score WHERE livestream_id = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, query, livestreamModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream: "+err.Error())
 		}
+	}
 
-		if err := dbConn.SelectContext(ctx, &livestreamIDs, "SELECT l.id FROM livestreams l JOIN livestream_tags lt ON lt.livestream_id = l.id WHERE tag_id=? GROUP BY l.id ORDER BY l.id DESC", tagID); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	startIndex, endIndex := reservationConfig.slotIDRange(livestreamModel.StartAt, livestreamModel.EndAt)
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE id >= ? AND id <= ?", startIndex, endIndex); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	reservationSlots.Release(startIndex, endIndex)
+
+	deleteLivestreamCache(livestreamModel.ID)
+	setCollaboratorIDs(livestreamModel.ID, nil)
+	recentLivecomments.Drop(livestreamModel.ID)
+
+	// 空いた枠で空き待ちを予約する
+	go processReservationWaitlist(context.Background())
+
+	ngwordLock.Lock()
+	delete(ngwordCache, livestreamModel.ID)
+	ngwordLock.Unlock()
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 配信予約の日時変更API
+// PUT /api/livestream/:livestream_id/schedule
+func rescheduleLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	sess := getSession(c)
+	userID := sess.Values.UserID
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req *RescheduleLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	verr := &ValidationError{}
+	reservationConfig.validateSchedule(verr, req.StartAt, req.EndAt, time.Now())
+	if err := verr.Err(); err != nil {
+		return err
+	}
+
+	livestreamUpdateLock.Lock()
+	defer livestreamUpdateLock.Unlock()
+
+	livestreamModel, exists := getLivestreamByID(int64(livestreamID))
+	if !exists {
+		return errLivestreamNotFound(int64(livestreamID))
+	}
+	if livestreamModel.UserID != userID {
+		return newForbiddenError("can't reschedule other streamer's livestream")
+	}
+	if err := reservationConfig.checkNotStarted(livestreamModel, time.Now()); err != nil {
+		return err
+	}
+
+	oldStartIndex, oldEndIndex := reservationConfig.slotIDRange(livestreamModel.StartAt, livestreamModel.EndAt)
+	newStartIndex, newEndIndex := reservationConfig.slotIDRange(req.StartAt, req.EndAt)
+	oldRange := slotRange{StartID: oldStartIndex, EndID: oldEndIndex}
+	newRange := slotRange{StartID: newStartIndex, EndID: newEndIndex}
+	// 新しく必要になる枠だけを先に確保する。元の枠はコミットするまで手放さない
+	// 枠のないidだけの区間は確保するものがない
+	addedRanges := []slotRange{}
+	for _, r := range newRange.subtract(oldRange) {
+		if reservationSlots.HasSlots(r.StartID, r.EndID) {
+			addedRanges = append(addedRanges, r)
 		}
-	} else {
-		// 検索条件なし
-		query := `SELECT l.id FROM livestreams l ORDER BY id DESC`
-		if c.QueryParam("limit") != "" {
-			limit, err := strconv.Atoi(c.QueryParam("limit"))
-			if err != nil {
-				return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-			}
-			query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	reserved := true
+	fullSlots := []ReservationSlotModel{}
+	for _, r := range reservationSlots.ReserveEach(addedRanges, true) {
+		reserved = reserved && r.OK
+		fullSlots = append(fullSlots, r.FullSlots...)
+	}
+	if !reserved && len(fullSlots) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to reserve reservation slots for the new schedule")
+	}
+	if !reserved {
+		return c.JSON(http.StatusBadRequest, &ReservationConflictResponse{
+			Error:     "reservation slots are full",
+			FullSlots: toReservationAvailabilities(fullSlots),
+		})
+	}
+	committed := false
+	defer func() {
+		if committed {
+			return
 		}
+		for _, r := range addedRanges {
+			reservationSlots.Release(r.StartID, r.EndID)
+		}
+	}()
 
-		if err := dbConn.SelectContext(ctx, &livestreamIDs, query); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE id >= ? AND id <= ?", oldStartIndex, oldEndIndex); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE id >= ? AND id <= ?", newStartIndex, newEndIndex); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET start_at = ?, end_at = ? WHERE id = ?", req.StartAt, req.EndAt, livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+
+	livestreamModel.StartAt = req.StartAt
+	livestreamModel.EndAt = req.EndAt
+
+	userMap, err := getUserMap(ctx, tx, []int64{userID})
+	if err != nil {
+		return err
+	}
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel, userMap)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	committed = true
+	for _, r := range oldRange.subtract(newRange) {
+		reservationSlots.Release(r.StartID, r.EndID)
+	}
+
+	setLivestreamCache(livestreamModel)
+
+	// 空いた枠で空き待ちを予約する
+	go processReservationWaitlist(context.Background())
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// 予約枠の空き状況取得API
+// GET /api/livestream/reservation/availability?from=&to=
+func getReservationAvailabilityHandler(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	from, err := strconv.ParseInt(c.QueryParam("from"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "from query parameter must be integer")
+	}
+	to, err := strconv.ParseInt(c.QueryParam("to"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "to query parameter must be integer")
+	}
+	if from >= to {
+		return echo.NewHTTPError(http.StatusBadRequest, "from must be before to")
+	}
+	if (to-from)/reservationConfig.SlotSeconds > maxAvailabilitySlots {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("too many slots requested (max %d)", maxAvailabilitySlots))
+	}
+
+	startIndex, endIndex := reservationConfig.slotIDRange(from, to)
+	slots := []ReservationSlotModel{}
+	for _, s := range reservationSlots.Slots(startIndex, endIndex) {
+		if s.StartAt >= from && s.EndAt <= to {
+			slots = append(slots, s)
 		}
 	}
-	livestreamModels := getLivestreamByIDs(livestreamIDs)
+
+	return c.JSON(http.StatusOK, toReservationAvailabilities(slots))
+}
+
+func toReservationAvailabilities(slots []ReservationSlotModel) []ReservationAvailability {
+	availabilities := make([]ReservationAvailability, len(slots))
+	for i, s := range slots {
+		availabilities[i] = ReservationAvailability{
+			StartAt:   s.StartAt,
+			EndAt:     s.EndAt,
+			Remaining: max(s.Slot, 0),
+		}
+	}
+	return availabilities
+}
+
+// 配信の検索API
+// q: タイトル・説明文のキーワード(空白区切りでAND)
+// tag, tags: タグ名(tagsはカンマ区切り)。tag_mode=and なら全てのタグを含むもの
+// owner: 配信者のユーザー名
+// from, to: 配信時間がかかっている範囲(unixtime)
+// status: live, upcoming, ended
+// cursor, limit: ページング
+func searchLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	query, err := parseLivestreamSearchQuery(c)
+	if err != nil {
+		return err
+	}
+
+	page, err := parsePageParams(c)
+	if err != nil {
+		return err
+	}
+
+	livestreamModels, nextCursor := page.apply(searchLivestreams(query))
 
 	livestreams := make([]Livestream, len(livestreamModels))
 	userIDs := []int64{}
@@ -250,7 +812,7 @@ func searchLivestreamsHandler(c echo.Context) error {
 		livestreams[i] = livestream
 	}
 
-	return c.JSON(http.StatusOK, livestreams)
+	return page.respond(c, livestreams, nextCursor)
 }
 
 func getMyLivestreamsHandler(c echo.Context) error {
@@ -262,11 +824,22 @@ func getMyLivestreamsHandler(c echo.Context) error {
 	sess := getSession(c)
 	userID := sess.Values.UserID
 
-	var livestreamIDs []int64
-	if err := dbConn.SelectContext(ctx, &livestreamIDs, "SELECT l.id FROM livestreams l WHERE user_id = ?", userID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	page, err := parsePageParams(c)
+	if err != nil {
+		return err
+	}
+
+	var livestreamModels []LivestreamModel
+	if page.Paginate {
+		livestreamModels = searchLivestreams(LivestreamSearchQuery{OwnerID: userID})
+	} else {
+		var livestreamIDs []int64
+		if err := dbConn.SelectContext(ctx, &livestreamIDs, "SELECT l.id FROM livestreams l WHERE user_id = ? ORDER BY l.id DESC", userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+		livestreamModels = getLivestreamByIDs(livestreamIDs)
 	}
-	livestreamModels := getLivestreamByIDs(livestreamIDs)
+	livestreamModels, nextCursor := page.apply(livestreamModels)
 	userMap, err := getUserMap(ctx, dbConn, []int64{userID})
 	if err != nil {
 		return err
@@ -280,7 +853,7 @@ func getMyLivestreamsHandler(c echo.Context) error {
 		livestreams[i] = livestream
 	}
 
-	return c.JSON(http.StatusOK, livestreams)
+	return page.respond(c, livestreams, nextCursor)
 }
 
 func getUserLivestreamsHandler(c echo.Context) error {
@@ -296,11 +869,22 @@ func getUserLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusNotFound, "user not found")
 	}
 
-	var livestreamIDs []int64
-	if err := dbConn.SelectContext(ctx, &livestreamIDs, "SELECT id FROM livestreams l WHERE user_id = ?", user.ID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	page, err := parsePageParams(c)
+	if err != nil {
+		return err
 	}
-	livestreamModels := getLivestreamByIDs(livestreamIDs)
+
+	var livestreamModels []LivestreamModel
+	if page.Paginate {
+		livestreamModels = searchLivestreams(LivestreamSearchQuery{OwnerID: user.ID})
+	} else {
+		var livestreamIDs []int64
+		if err := dbConn.SelectContext(ctx, &livestreamIDs, "SELECT id FROM livestreams l WHERE user_id = ? ORDER BY id DESC", user.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+		livestreamModels = getLivestreamByIDs(livestreamIDs)
+	}
+	livestreamModels, nextCursor := page.apply(livestreamModels)
 	userMap := map[int64]UserModel{
 		user.ID: user,
 	}
@@ -313,7 +897,7 @@ func getUserLivestreamsHandler(c echo.Context) error {
 		livestreams[i] = livestream
 	}
 
-	return c.JSON(http.StatusOK, livestreams)
+	return page.respond(c, livestreams, nextCursor)
 }
 
 // viewerテーブルの廃止
@@ -332,6 +916,14 @@ func enterLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id must be integer")
 	}
 
+	livestreamModel, exists := getLivestreamByID(int64(livestreamID))
+	if !exists {
+		return errLivestreamNotFound(int64(livestreamID))
+	}
+	if err := livestreamStatusConfig.checkOpen(livestreamModel, time.Now()); err != nil {
+		return err
+	}
+
 	viewer := LivestreamViewerModel{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
@@ -360,6 +952,10 @@ func exitLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
+	if _, exists := getLivestreamByID(int64(livestreamID)); !exists {
+		return errLivestreamNotFound(int64(livestreamID))
+	}
+
 	if _, err := dbConn.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
 	}
@@ -381,7 +977,7 @@ func getLivestreamHandler(c echo.Context) error {
 
 	livestreamModel, exists := getLivestreamByID(int64(livestreamID))
 	if !exists {
-		return fmt.Errorf("livestream %d not found", livestreamID)
+		return errLivestreamNotFound(int64(livestreamID))
 	}
 
 	userMap, err := getUserMap(ctx, dbConn, []int64{livestreamModel.UserID})
@@ -410,14 +1006,14 @@ func getLivecommentReportsHandler(c echo.Context) error {
 
 	livestreamModel, exists := getLivestreamByID(int64(livestreamID))
 	if !exists {
-		return fmt.Errorf("livestream %d not found", livestreamID)
+		return errLivestreamNotFound(int64(livestreamID))
 	}
 
 	sess := getSession(c)
 	userID := sess.Values.UserID
 
-	if livestreamModel.UserID != userID {
-		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
+	if !canModerateLivestream(livestreamModel, userID) {
+		return newForbiddenError("can't get other streamer's livecomment reports")
 	}
 
 	var reportModels []*LivecommentReportModel
@@ -458,7 +1054,16 @@ func fillLivestreamResponse(ctx context.Context, tx dbtx, livestreamModel Livest
 	for _, tid := range rawTags {
 		if tid != "" {
 			tidint, _ := strconv.ParseInt(tid, 10, 64)
-			tags = append(tags, TagMap[tidint])
+			if tag, ok := getTagByID(tidint); ok {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	collaborators := []User{}
+	for _, collaboratorID := range getCollaboratorIDs(livestreamModel.ID) {
+		if um, ok := getUserByID(collaboratorID); ok {
+			collaborators = append(collaborators, um.toUser())
 		}
 	}
 
@@ -483,15 +1088,19 @@ func fillLivestreamResponse(ctx context.Context, tx dbtx, livestreamModel Livest
 	*/
 
 	livestream := Livestream{
-		ID:           livestreamModel.ID,
-		Owner:        owner,
-		Title:        livestreamModel.Title,
-		Tags:         tags,
-		Description:  livestreamModel.Description,
-		PlaylistUrl:  livestreamModel.PlaylistUrl,
-		ThumbnailUrl: livestreamModel.ThumbnailUrl,
-		StartAt:      livestreamModel.StartAt,
-		EndAt:        livestreamModel.EndAt,
+		ID:                  livestreamModel.ID,
+		Owner:               owner,
+		Title:               livestreamModel.Title,
+		Tags:                tags,
+		Description:         livestreamModel.Description,
+		PlaylistUrl:         livestreamModel.PlaylistUrl,
+		ThumbnailUrl:        livestreamModel.ThumbnailUrl,
+		StartAt:             livestreamModel.StartAt,
+		EndAt:               livestreamModel.EndAt,
+		SeriesID:            livestreamModel.SeriesID,
+		Collaborators:       collaborators,
+		Status:              livestreamStatus(livestreamModel, time.Now().Unix()),
+		PlaylistUnreachable: isPlaylistUnreachable(livestreamModel.ID),
 	}
 	return livestream, nil
 }
@@ -507,6 +1116,28 @@ func getLivestreamByID(id int64) (LivestreamModel, bool) {
 	return livestream, true
 }
 
+// キャッシュと検索インデックスを更新する
+func setLivestreamCache(livestreamModels ...LivestreamModel) {
+	livestreamLock.Lock()
+	defer livestreamLock.Unlock()
+	for _, l := range livestreamModels {
+		if old, ok := livestreamCache[l.ID]; ok {
+			livestreamSearchIndex.remove(old)
+		}
+		livestreamCache[l.ID] = l
+		livestreamSearchIndex.add(l)
+	}
+}
+
+func deleteLivestreamCache(id int64) {
+	livestreamLock.Lock()
+	defer livestreamLock.Unlock()
+	if old, ok := livestreamCache[id]; ok {
+		livestreamSearchIndex.remove(old)
+	}
+	delete(livestreamCache, id)
+}
+
 func getLivestreamByIDs(ids []int64) []LivestreamModel {
 	livestreamLock.RLock()
 	defer livestreamLock.RUnlock()
@@ -534,10 +1165,13 @@ func warmupLivestreamCache(ctx context.Context) {
 	if err := dbConn.SelectContext(ctx, &livestreams, query); err != nil {
 		return
 	}
+	index := newSearchIndex()
 	for _, l := range livestreams {
 		lCache[l.ID] = l
+		index.add(l)
 	}
 	livestreamLock.Lock()
 	livestreamCache = lCache
+	livestreamSearchIndex = index
 	livestreamLock.Unlock()
 }
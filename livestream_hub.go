@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	livestreamEventLivecomment        = "livecomment"
+	livestreamEventLivecommentDeleted = "livecomment_deleted"
+	livestreamEventReaction           = "reaction"
+	livestreamEventViewers            = "viewers"
+	// 購読者ごとに溜められるイベント数。溢れた購読者は切断して再接続させる
+	livestreamEventBufferSize = 256
+)
+
+// 配信ごとのイベント
+// ID はイベントの種類ごとの通し番号 (livecomments.id など)。通し番号がないものは0
+type LivestreamEvent struct {
+	ID   int64
+	Type string
+	Data any
+}
+
+type livestreamSubscription struct {
+	livestreamID int64
+	C            chan LivestreamEvent
+}
+
+// 配信ごとのプロセス内 pub/sub
+type livestreamHub struct {
+	mu          sync.Mutex
+	subscribers map[int64]map[*livestreamSubscription]struct{}
+	// WebSocket で接続中の視聴者数
+	viewers map[int64]int64
+}
+
+var livestreamEvents = &livestreamHub{
+	subscribers: map[int64]map[*livestreamSubscription]struct{}{},
+	viewers:     map[int64]int64{},
+}
+
+func (h *livestreamHub) Subscribe(livestreamID int64) *livestreamSubscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sub := &livestreamSubscription{
+		livestreamID: livestreamID,
+		C:            make(chan LivestreamEvent, livestreamEventBufferSize),
+	}
+	if _, ok := h.subscribers[livestreamID]; !ok {
+		h.subscribers[livestreamID] = map[*livestreamSubscription]struct{}{}
+	}
+	h.subscribers[livestreamID][sub] = struct{}{}
+	return sub
+}
+
+func (h *livestreamHub) Unsubscribe(sub *livestreamSubscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(sub)
+}
+
+func (h *livestreamHub) remove(sub *livestreamSubscription) {
+	subs, ok := h.subscribers[sub.livestreamID]
+	if !ok {
+		return
+	}
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	close(sub.C)
+	if len(subs) == 0 {
+		delete(h.subscribers, sub.livestreamID)
+	}
+}
+
+// 送信は待たない。受信が追いつかない購読者はチャネルを閉じて外す
+func (h *livestreamHub) Publish(livestreamID int64, event LivestreamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subscribers[livestreamID] {
+		select {
+		case sub.C <- event:
+		default:
+			h.remove(sub)
+		}
+	}
+}
+
+type LivecommentDeletion struct {
+	LivecommentIDs []int64 `json:"livecomment_ids"`
+}
+
+type ViewerCount struct {
+	Viewers int64 `json:"viewers"`
+}
+
+// モデレーションで削除したコメントを配信ごとに知らせる
+func publishLivecommentDeletions(livecommentModels []LivecommentModel) {
+	deleted := map[int64][]int64{}
+	for _, l := range livecommentModels {
+		deleted[l.LivestreamID] = append(deleted[l.LivestreamID], l.ID)
+	}
+	for livestreamID, ids := range deleted {
+		livestreamEvents.Publish(livestreamID, LivestreamEvent{
+			Type: livestreamEventLivecommentDeleted,
+			Data: LivecommentDeletion{LivecommentIDs: ids},
+		})
+	}
+}
+
+// 接続中の視聴者数を数えて、変わるたびに知らせる
+func (h *livestreamHub) Join(livestreamID int64) {
+	h.mu.Lock()
+	h.viewers[livestreamID]++
+	viewers := h.viewers[livestreamID]
+	h.mu.Unlock()
+	h.Publish(livestreamID, LivestreamEvent{Type: livestreamEventViewers, Data: ViewerCount{Viewers: viewers}})
+}
+
+func (h *livestreamHub) Leave(livestreamID int64) {
+	h.mu.Lock()
+	h.viewers[livestreamID]--
+	viewers := h.viewers[livestreamID]
+	if viewers <= 0 {
+		delete(h.viewers, livestreamID)
+	}
+	h.mu.Unlock()
+	h.Publish(livestreamID, LivestreamEvent{Type: livestreamEventViewers, Data: ViewerCount{Viewers: viewers}})
+}
+
+func (h *livestreamHub) Viewers(livestreamID int64) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.viewers[livestreamID]
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// タイトルと説明文の2文字ずつ(bi-gram)の転置インデックス
+// 日本語は単語で区切れないので、キーワードのbi-gramを全て含む配信を候補にしてから部分一致で確かめる
+// タグIDごとの配信IDの昇順リストも持つ
+// livestreamCache と一緒に livestreamLock で守る
+type searchIndex struct {
+	postings map[string]map[int64]struct{}
+	tags     map[int64][]int64
+}
+
+var livestreamSearchIndex = newSearchIndex()
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: map[string]map[int64]struct{}{},
+		tags:     map[int64][]int64{},
+	}
+}
+
+func searchText(livestreamModel LivestreamModel) string {
+	return strings.ToLower(livestreamModel.Title + "\n" + livestreamModel.Description)
+}
+
+func bigrams(text string) []string {
+	runes := []rune(text)
+	grams := []string{}
+	for i := 0; i+1 < len(runes); i++ {
+		grams = append(grams, string(runes[i:i+2]))
+	}
+	slices.Sort(grams)
+	return slices.Compact(grams)
+}
+
+func (idx *searchIndex) add(livestreamModel LivestreamModel) {
+	for _, g := range bigrams(searchText(livestreamModel)) {
+		ids, ok := idx.postings[g]
+		if !ok {
+			ids = map[int64]struct{}{}
+			idx.postings[g] = ids
+		}
+		ids[livestreamModel.ID] = struct{}{}
+	}
+	for _, tagID := range rawTagIDs(livestreamModel.RawTags) {
+		ids := idx.tags[tagID]
+		if i, found := slices.BinarySearch(ids, livestreamModel.ID); !found {
+			idx.tags[tagID] = slices.Insert(ids, i, livestreamModel.ID)
+		}
+	}
+}
+
+func (idx *searchIndex) remove(livestreamModel LivestreamModel) {
+	for _, g := range bigrams(searchText(livestreamModel)) {
+		delete(idx.postings[g], livestreamModel.ID)
+		if len(idx.postings[g]) == 0 {
+			delete(idx.postings, g)
+		}
+	}
+	for _, tagID := range rawTagIDs(livestreamModel.RawTags) {
+		ids := idx.tags[tagID]
+		if i, found := slices.BinarySearch(ids, livestreamModel.ID); found {
+			idx.tags[tagID] = slices.Delete(ids, i, i+1)
+		}
+		if len(idx.tags[tagID]) == 0 {
+			delete(idx.tags, tagID)
+		}
+	}
+}
+
+func rawTagIDs(rawTags string) []int64 {
+	tagIDs := []int64{}
+	for _, tid := range strings.Split(rawTags, ",") {
+		if tagID, err := strconv.ParseInt(tid, 10, 64); err == nil {
+			tagIDs = append(tagIDs, tagID)
+		}
+	}
+	return tagIDs
+}
+
+// タグを含む配信のID
+// グループ内のいずれかのタグを含めばそのグループに当たったとみなす
+// matchAll なら全てのグループに当たるもの、そうでなければいずれかに当たるもの
+func (idx *searchIndex) tagCandidates(tagGroups [][]int64, matchAll bool) map[int64]struct{} {
+	counts := map[int64]int{}
+	for _, group := range tagGroups {
+		hit := map[int64]struct{}{}
+		for _, tagID := range group {
+			for _, id := range idx.tags[tagID] {
+				hit[id] = struct{}{}
+			}
+		}
+		for id := range hit {
+			counts[id]++
+		}
+	}
+	result := make(map[int64]struct{}, len(counts))
+	for id, n := range counts {
+		if !matchAll || n == len(tagGroups) {
+			result[id] = struct{}{}
+		}
+	}
+	return result
+}
+
+// キーワードのbi-gramを全て含む配信のID
+// 1文字のキーワードは絞り込めないので ok=false を返す
+func (idx *searchIndex) candidates(keyword string) (map[int64]struct{}, bool) {
+	grams := bigrams(keyword)
+	if len(grams) == 0 {
+		return nil, false
+	}
+	var result map[int64]struct{}
+	for _, g := range grams {
+		ids := idx.postings[g]
+		if result == nil {
+			result = make(map[int64]struct{}, len(ids))
+			for id := range ids {
+				result[id] = struct{}{}
+			}
+			continue
+		}
+		for id := range result {
+			if _, ok := ids[id]; !ok {
+				delete(result, id)
+			}
+		}
+	}
+	return result, true
+}
+
+type LivestreamSearchQuery struct {
+	// タイトルか説明文に全て含むもの
+	Keywords []string
+	// 指定されたタグごとの、そのタグと子孫のタグのID
+	TagGroups [][]int64
+	// 全てのタグを含むか(and)、いずれかを含むか(or)
+	MatchAllTags bool
+	OwnerID      int64
+	// [From, To) に配信時間がかかっているもの。0なら制限しない
+	From   int64
+	To     int64
+	Status string
+}
+
+func parseLivestreamSearchQuery(c echo.Context) (LivestreamSearchQuery, error) {
+	q := LivestreamSearchQuery{}
+
+	for _, k := range strings.Fields(c.QueryParam("q")) {
+		q.Keywords = append(q.Keywords, strings.ToLower(k))
+	}
+
+	tagNames := []string{}
+	if tag := c.QueryParam("tag"); tag != "" {
+		tagNames = append(tagNames, tag)
+	}
+	for _, tag := range strings.Split(c.QueryParam("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tagNames = append(tagNames, tag)
+		}
+	}
+	// 子タグの配信も親タグで見つかるようにする
+	for _, name := range tagNames {
+		tagID, ok := getTagIDByName(name)
+		if !ok {
+			return q, echo.NewHTTPError(http.StatusNotFound, "tag not found")
+		}
+		q.TagGroups = append(q.TagGroups, tagWithDescendants(tagID))
+	}
+	switch c.QueryParam("tag_mode") {
+	case "", "or":
+	case "and":
+		q.MatchAllTags = true
+	default:
+		return q, echo.NewHTTPError(http.StatusBadRequest, "tag_mode query parameter must be and or or")
+	}
+
+	if owner := c.QueryParam("owner"); owner != "" {
+		user, ok := getUserByName(owner)
+		if !ok {
+			return q, echo.NewHTTPError(http.StatusNotFound, "user not found")
+		}
+		q.OwnerID = user.ID
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *int64
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if v := c.QueryParam(p.name); v != "" {
+			t, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return q, echo.NewHTTPError(http.StatusBadRequest, p.name+" query parameter must be integer")
+			}
+			*p.dst = t
+		}
+	}
+
+	if status := c.QueryParam("status"); status != "" {
+		if !isLivestreamStatus(status) {
+			return q, echo.NewHTTPError(http.StatusBadRequest, "status query parameter must be live, upcoming or ended")
+		}
+		q.Status = status
+	}
+
+	return q, nil
+}
+
+func (q LivestreamSearchQuery) match(livestreamModel LivestreamModel, now int64) bool {
+	if q.OwnerID != 0 && livestreamModel.UserID != q.OwnerID {
+		return false
+	}
+	if q.From != 0 && livestreamModel.EndAt <= q.From {
+		return false
+	}
+	if q.To != 0 && livestreamModel.StartAt >= q.To {
+		return false
+	}
+	if q.Status != "" && livestreamStatus(livestreamModel, now) != q.Status {
+		return false
+	}
+	if len(q.Keywords) > 0 {
+		text := searchText(livestreamModel)
+		for _, k := range q.Keywords {
+			if !strings.Contains(text, k) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 条件に合う配信をIDの降順で返す
+func searchLivestreams(q LivestreamSearchQuery) []LivestreamModel {
+	livestreamLock.RLock()
+	defer livestreamLock.RUnlock()
+
+	// タグとキーワードそれぞれの候補のうち一番小さいものだけを調べる
+	// タグの条件はインデックスで確定するので、キーワードで絞り込んだときはタグも確かめる
+	var candidates map[int64]struct{}
+	var tagged map[int64]struct{}
+	if len(q.TagGroups) > 0 {
+		tagged = livestreamSearchIndex.tagCandidates(q.TagGroups, q.MatchAllTags)
+		candidates = tagged
+	}
+	for _, k := range q.Keywords {
+		ids, ok := livestreamSearchIndex.candidates(k)
+		if !ok {
+			continue
+		}
+		if candidates == nil || len(ids) < len(candidates) {
+			candidates = ids
+		}
+	}
+
+	now := time.Now().Unix()
+	livestreams := []LivestreamModel{}
+	if candidates != nil {
+		for id := range candidates {
+			if tagged != nil {
+				if _, ok := tagged[id]; !ok {
+					continue
+				}
+			}
+			if l, ok := livestreamCache[id]; ok && q.match(l, now) {
+				livestreams = append(livestreams, l)
+			}
+		}
+	} else {
+		for _, l := range livestreamCache {
+			if q.match(l, now) {
+				livestreams = append(livestreams, l)
+			}
+		}
+	}
+	slices.SortFunc(livestreams, func(a, b LivestreamModel) int {
+		switch {
+		case a.ID > b.ID:
+			return -1
+		case a.ID < b.ID:
+			return 1
+		}
+		return 0
+	})
+	return livestreams
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	livestreamStatusEnforceEnvKey = "ISUCON13_LIVESTREAM_ENFORCE_STATUS"
+	livestreamStatusGraceEnvKey   = "ISUCON13_LIVESTREAM_GRACE_PERIOD"
+)
+
+const (
+	livestreamStatusUpcoming = "upcoming"
+	livestreamStatusLive     = "live"
+	livestreamStatusEnded    = "ended"
+)
+
+type LivestreamStatusConfig struct {
+	// 配信時間外の入室・コメント・リアクションを拒否する
+	// 配信時間が過去に固定されているベンチマーク環境では無効にしておく
+	Enforce bool
+	// 開始前・終了後もこの時間だけは受け付ける
+	GracePeriod time.Duration
+}
+
+var livestreamStatusConfig = LivestreamStatusConfig{}
+
+func loadLivestreamStatusConfig() error {
+	conf := livestreamStatusConfig
+	if v, ok := os.LookupEnv(livestreamStatusEnforceEnvKey); ok {
+		enforce, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", livestreamStatusEnforceEnvKey, err)
+		}
+		conf.Enforce = enforce
+	}
+	if v, ok := os.LookupEnv(livestreamStatusGraceEnvKey); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("environment variable '%s' must be non-negative duration: %s", livestreamStatusGraceEnvKey, v)
+		}
+		conf.GracePeriod = d
+	}
+	livestreamStatusConfig = conf
+	return nil
+}
+
+func isLivestreamStatus(status string) bool {
+	switch status {
+	case livestreamStatusUpcoming, livestreamStatusLive, livestreamStatusEnded:
+		return true
+	}
+	return false
+}
+
+func livestreamStatus(livestreamModel LivestreamModel, now int64) string {
+	switch {
+	case now < livestreamModel.StartAt:
+		return livestreamStatusUpcoming
+	case now < livestreamModel.EndAt:
+		return livestreamStatusLive
+	default:
+		return livestreamStatusEnded
+	}
+}
+
+// 配信中(猶予期間を含む)でなければエラーを返す
+func (conf LivestreamStatusConfig) checkOpen(livestreamModel LivestreamModel, now time.Time) error {
+	if !conf.Enforce {
+		return nil
+	}
+	grace := int64(conf.GracePeriod / time.Second)
+	if now.Unix() < livestreamModel.StartAt-grace {
+		return newForbiddenError("livestream %d has not started yet", livestreamModel.ID)
+	}
+	if now.Unix() >= livestreamModel.EndAt+grace {
+		return newForbiddenError("livestream %d has already ended", livestreamModel.ID)
+	}
+	return nil
+}
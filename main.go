@@ -5,17 +5,21 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/goccy/go-json"
-	"github.com/gofiber/fiber/v2"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 )
@@ -115,6 +119,15 @@ func initializeHandler(c echo.Context) error {
 	if _, err := dbConn.ExecContext(ctx, `TRUNCATE TABLE livestream_score`); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to truncate score: "+err.Error())
 	}
+	for _, table := range []string{"reservation_waitlist", "notifications", "livestream_collaborators", "follows", "tag_aliases", "livecomment_deletion_logs"} {
+		if _, err := dbConn.ExecContext(ctx, "TRUNCATE TABLE "+table); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to truncate "+table+": "+err.Error())
+		}
+	}
+
+	if err := resetTags(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reset tags: "+err.Error())
+	}
 
 	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
 		c.Logger().Warnf("init.sh failed with err=%s", string(out))
@@ -132,9 +145,16 @@ func initializeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, string(out)+": "+err.Error())
 	}
 
+	if err := warmupTagCache(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load tags: "+err.Error())
+	}
 	warmupUsersCache(ctx)
 	warmupLivestreamCache(ctx)
 	warmupNGWordCache(ctx)
+	warmupSlotAllocator(ctx)
+	warmupCollaboratorCache(ctx)
+	warmupFollowCache(ctx)
+	recentLivecomments.Reset()
 
 	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
 	return c.JSON(http.StatusOK, InitializeResponse{
@@ -160,7 +180,19 @@ func (j *JSONSerializer) Deserialize(c echo.Context, i interface{}) error {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reservation-slots" {
+		if err := runReservationSlotsCommand(os.Args[2:]); err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	e := echo.New()
+	if err := loadStreamingConfig(); err != nil {
+		e.Logger.Errorf("failed to load streaming config: %v", err)
+		os.Exit(1)
+	}
 	// e.Debug = false
 	// e.Logger.SetLevel(echolog.DEBUG)
 	// e.Use(middleware.Logger())
@@ -175,19 +207,36 @@ func main() {
 
 	// top
 	e.GET("/api/tag", getTagHandler)
+	e.POST("/api/admin/tag", createTagHandler)
+	e.PATCH("/api/admin/tag/:tag_id", updateTagHandler)
+	e.DELETE("/api/admin/tag/:tag_id", retireTagHandler)
 	e.GET("/api/user/:username/theme", getStreamerThemeHandler)
 
 	// livestream
 	// reserve livestream
 	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
+	e.GET("/api/livestream/reservation/availability", getReservationAvailabilityHandler)
+	e.GET("/api/livestream/reservation/waitlist", getReservationWaitlistHandler)
 	// list livestream
 	e.GET("/api/livestream/search", searchLivestreamsHandler)
+	e.GET("/api/livestream/recommended", getRecommendedLivestreamsHandler)
+	e.GET("/api/livestream/following", getFollowingLivestreamsHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
 	// get livestream
 	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
+	// edit / cancel / reschedule livestream
+	e.PATCH("/api/livestream/:livestream_id", updateLivestreamHandler)
+	e.DELETE("/api/livestream/:livestream_id", cancelLivestreamHandler)
+	e.PUT("/api/livestream/:livestream_id/schedule", rescheduleLivestreamHandler)
 	// get polling livecomment timeline
 	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
+	if streamingEnabled {
+		// livecomment timeline over Server-Sent Events
+		e.GET("/api/livestream/:livestream_id/livecomment/stream", streamLivecommentsHandler)
+		// livecomments, reactions and viewer counts over WebSocket
+		e.GET("/api/livestream/:livestream_id/ws", livestreamWebSocketHandler)
+	}
 	// ライブコメント投稿
 	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
 	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
@@ -214,8 +263,11 @@ func main() {
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
 	e.GET("/api/user/:username", getUserHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
+	e.POST("/api/user/:username/follow", followUserHandler)
+	e.DELETE("/api/user/:username/follow", unfollowUserHandler)
 	e.GET("/api/user/:username/icon", getIconHandler)
 	e.POST("/api/icon", postIconHandler)
+	e.GET("/api/notification", getNotificationsHandler)
 
 	// stats
 	// ライブ配信統計情報
@@ -242,30 +294,123 @@ func main() {
 	}
 	powerDNSSubdomainAddress = subdomainAddr
 
+	if err := loadReservationConfig(); err != nil {
+		e.Logger.Errorf("failed to load reservation config: %v", err)
+		os.Exit(1)
+	}
+	if err := loadLivestreamStatusConfig(); err != nil {
+		e.Logger.Errorf("failed to load livestream status config: %v", err)
+		os.Exit(1)
+	}
+	loadAdminConfig()
+	if err := loadMediaURLConfig(); err != nil {
+		e.Logger.Errorf("failed to load media url config: %v", err)
+		os.Exit(1)
+	}
+
+	if err := warmupTagCache(context.Background()); err != nil {
+		e.Logger.Errorf("failed to load tags: %v", err)
+		os.Exit(1)
+	}
 	warmupUsersCache(context.Background())
 	warmupLivestreamCache(context.Background())
 	warmupNGWordCache(context.Background())
+	warmupSlotAllocator(context.Background())
+	warmupCollaboratorCache(context.Background())
+	warmupFollowCache(context.Background())
 
-	fiberApp := fiber.New(fiber.Config{
-		DisableDefaultDate: true,
-	})
-
-	fiberApp.Get("/api/user/:username/icon", getIconFiber)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	go func() {
-		fiberApp.Listen(":3000")
-	}()
+	go runPlaylistChecker(ctx)
 
 	// HTTPサーバ起動
-	listenAddr := net.JoinHostPort("", strconv.Itoa(listenPort))
-	if err := e.Start(listenAddr); err != nil {
+	if err := serve(ctx, e); err != nil {
 		e.Logger.Errorf("failed to start HTTP server: %v", err)
 		os.Exit(1)
 	}
 }
 
 type ErrorResponse struct {
-	Error string `json:"error"`
+	Error  string            `json:"error"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// ハンドラが返すエラーの種類。errorResponseHandler でHTTPのステータスコードに対応付ける
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrForbidden  = errors.New("forbidden")
+	ErrConflict   = errors.New("conflict")
+	ErrValidation = errors.New("validation failed")
+)
+
+// DomainError は種類とメッセージを持つエラー
+type DomainError struct {
+	Kind    error
+	Message string
+}
+
+func (e *DomainError) Error() string {
+	return e.Message
+}
+
+func (e *DomainError) Unwrap() error {
+	return e.Kind
+}
+
+func newNotFoundError(format string, args ...any) error {
+	return &DomainError{Kind: ErrNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+func newForbiddenError(format string, args ...any) error {
+	return &DomainError{Kind: ErrForbidden, Message: fmt.Sprintf(format, args...)}
+}
+
+func newConflictError(format string, args ...any) error {
+	return &DomainError{Kind: ErrConflict, Message: fmt.Sprintf(format, args...)}
+}
+
+func errLivestreamNotFound(livestreamID int64) error {
+	return newNotFoundError("livestream %d not found", livestreamID)
+}
+
+// ValidationError はリクエストのフィールドごとの不備をまとめたもの
+type ValidationError struct {
+	Fields map[string]string
+}
+
+func (e *ValidationError) Add(field, message string) {
+	if e.Fields == nil {
+		e.Fields = map[string]string{}
+	}
+	if _, ok := e.Fields[field]; !ok {
+		e.Fields[field] = message
+	}
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for f := range e.Fields {
+		fields = append(fields, f)
+	}
+	slices.Sort(fields)
+	messages := make([]string, len(fields))
+	for i, f := range fields {
+		messages[i] = f + ": " + e.Fields[f]
+	}
+	return "invalid request: " + strings.Join(messages, ", ")
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrValidation
+}
+
+// 不備がなければnilを返す
+func (e *ValidationError) Err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
 }
 
 func errorResponseHandler(err error, c echo.Context) {
@@ -277,7 +422,26 @@ func errorResponseHandler(err error, c echo.Context) {
 		return
 	}
 
-	if e := c.JSON(http.StatusInternalServerError, &ErrorResponse{Error: err.Error()}); e != nil {
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		if e := c.JSON(http.StatusBadRequest, &ErrorResponse{Error: ve.Error(), Fields: ve.Fields}); e != nil {
+			c.Logger().Errorf("%+v", e)
+		}
+		return
+	}
+
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, ErrForbidden):
+		code = http.StatusForbidden
+	case errors.Is(err, ErrConflict):
+		code = http.StatusConflict
+	case errors.Is(err, ErrValidation):
+		code = http.StatusBadRequest
+	}
+	if e := c.JSON(code, &ErrorResponse{Error: err.Error()}); e != nil {
 		c.Logger().Errorf("%+v", e)
 	}
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mediaURLSchemesEnvKey       = "ISUCON13_MEDIA_URL_SCHEMES"
+	mediaURLHostsEnvKey         = "ISUCON13_MEDIA_URL_HOSTS"
+	playlistRequireM3U8EnvKey   = "ISUCON13_PLAYLIST_REQUIRE_M3U8"
+	playlistCheckOriginEnvKey   = "ISUCON13_PLAYLIST_CHECK_ORIGIN"
+	playlistCheckIntervalEnvKey = "ISUCON13_PLAYLIST_CHECK_INTERVAL"
+)
+
+const playlistCheckRequestTimeout = 5 * time.Second
+
+type MediaURLConfig struct {
+	Schemes []string
+	// 空なら全てのホストを許可する
+	Hosts []string
+	// .m3u8 以外のプレイリストURLを拒否する
+	// 既存のクライアントが送るURLを弾かないよう、デフォルトは無効
+	RequireM3U8 bool
+	// プレイリストの疎通確認先。空なら確認しない
+	// プレイリストURLのパスとクエリをこのオリジンに付け替えて取得する
+	CheckOrigin   *url.URL
+	CheckInterval time.Duration
+}
+
+var mediaURLConfig = MediaURLConfig{
+	Schemes:       []string{"https", "http"},
+	CheckInterval: time.Minute,
+}
+
+func splitList(v string) []string {
+	list := []string{}
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func loadMediaURLConfig() error {
+	conf := mediaURLConfig
+	if v, ok := os.LookupEnv(mediaURLSchemesEnvKey); ok {
+		conf.Schemes = splitList(v)
+		if len(conf.Schemes) == 0 {
+			return fmt.Errorf("environment variable '%s' must not be empty", mediaURLSchemesEnvKey)
+		}
+	}
+	if v, ok := os.LookupEnv(mediaURLHostsEnvKey); ok {
+		conf.Hosts = splitList(v)
+	}
+	if v, ok := os.LookupEnv(playlistRequireM3U8EnvKey); ok {
+		require, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", playlistRequireM3U8EnvKey, err)
+		}
+		conf.RequireM3U8 = require
+	}
+	if v, ok := os.LookupEnv(playlistCheckOriginEnvKey); ok && v != "" {
+		origin, err := url.Parse(v)
+		if err != nil || origin.Scheme == "" || origin.Host == "" {
+			return fmt.Errorf("environment variable '%s' must be an origin like http://127.0.0.1:8081: %s", playlistCheckOriginEnvKey, v)
+		}
+		conf.CheckOrigin = origin
+	}
+	if v, ok := os.LookupEnv(playlistCheckIntervalEnvKey); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("environment variable '%s' must be positive duration: %s", playlistCheckIntervalEnvKey, v)
+		}
+		conf.CheckInterval = d
+	}
+	mediaURLConfig = conf
+	return nil
+}
+
+// 空のURLは未設定として許可する
+func (conf MediaURLConfig) validateURL(verr *ValidationError, field, rawURL string) *url.URL {
+	if rawURL == "" {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		verr.Add(field, "must be an absolute URL")
+		return nil
+	}
+	if !slices.Contains(conf.Schemes, strings.ToLower(u.Scheme)) {
+		verr.Add(field, "scheme must be one of "+strings.Join(conf.Schemes, ", "))
+		return nil
+	}
+	if len(conf.Hosts) > 0 && !slices.Contains(conf.Hosts, strings.ToLower(u.Hostname())) {
+		verr.Add(field, "host is not allowed")
+		return nil
+	}
+	return u
+}
+
+func (conf MediaURLConfig) validatePlaylistURL(verr *ValidationError, rawURL string) {
+	u := conf.validateURL(verr, "playlist_url", rawURL)
+	if u != nil && conf.RequireM3U8 && !strings.HasSuffix(strings.ToLower(u.Path), ".m3u8") {
+		verr.Add("playlist_url", "playlist must be an HLS .m3u8 URL")
+	}
+}
+
+func (conf MediaURLConfig) validateThumbnailURL(verr *ValidationError, rawURL string) {
+	conf.validateURL(verr, "thumbnail_url", rawURL)
+}
+
+var (
+	playlistStatusLock sync.RWMutex
+	// プレイリストが取得できなかった配信
+	unreachablePlaylists = map[int64]struct{}{}
+)
+
+func isPlaylistUnreachable(livestreamID int64) bool {
+	playlistStatusLock.RLock()
+	defer playlistStatusLock.RUnlock()
+	_, ok := unreachablePlaylists[livestreamID]
+	return ok
+}
+
+// 配信中・配信予定の配信のプレイリストを定期的に取得し、取得できないものに印を付ける
+func runPlaylistChecker(ctx context.Context) {
+	conf := mediaURLConfig
+	if conf.CheckOrigin == nil {
+		return
+	}
+	client := &http.Client{Timeout: playlistCheckRequestTimeout}
+	ticker := time.NewTicker(conf.CheckInterval)
+	defer ticker.Stop()
+	for {
+		conf.checkPlaylists(ctx, client)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (conf MediaURLConfig) checkPlaylists(ctx context.Context, client *http.Client) {
+	now := time.Now().Unix()
+	unreachable := map[int64]struct{}{}
+	for _, l := range searchLivestreams(LivestreamSearchQuery{}) {
+		if l.PlaylistUrl == "" || livestreamStatus(l, now) == livestreamStatusEnded {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err := conf.fetchPlaylist(ctx, client, l.PlaylistUrl); err != nil {
+			unreachable[l.ID] = struct{}{}
+			log.Printf("playlist of livestream %d is unreachable: %v", l.ID, err)
+		}
+	}
+	playlistStatusLock.Lock()
+	unreachablePlaylists = unreachable
+	playlistStatusLock.Unlock()
+}
+
+func (conf MediaURLConfig) fetchPlaylist(ctx context.Context, client *http.Client, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	target := *conf.CheckOrigin
+	target.Path = u.Path
+	target.RawQuery = u.RawQuery
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+type NotificationModel struct {
+	ID           int64  `db:"id"`
+	UserID       int64  `db:"user_id"`
+	LivestreamID int64  `db:"livestream_id"`
+	Message      string `db:"message"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type Notification struct {
+	ID           int64  `json:"id"`
+	LivestreamID int64  `json:"livestream_id,omitempty"`
+	Message      string `json:"message"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+const maxNotifications = 100
+
+func insertNotification(ctx context.Context, tx sqlx.ExecerContext, userID, livestreamID int64, message string) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO notifications (user_id, livestream_id, message, created_at) VALUES (?, ?, ?, ?)", userID, livestreamID, message, time.Now().Unix())
+	return err
+}
+
+// 通知一覧API
+// GET /api/notification
+func getNotificationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	sess := getSession(c)
+	userID := sess.Values.UserID
+
+	var notificationModels []NotificationModel
+	if err := dbConn.SelectContext(ctx, &notificationModels, "SELECT * FROM notifications WHERE user_id = ? ORDER BY id DESC LIMIT ?", userID, maxNotifications); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get notifications: "+err.Error())
+	}
+
+	notifications := make([]Notification, len(notificationModels))
+	for i, n := range notificationModels {
+		notifications[i] = Notification{
+			ID:           n.ID,
+			LivestreamID: n.LivestreamID,
+			Message:      n.Message,
+			CreatedAt:    n.CreatedAt,
+		}
+	}
+
+	return c.JSON(http.StatusOK, notifications)
+}
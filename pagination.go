@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// cursor を付けたリクエストにだけページングした結果を返す
+// cursor なしのときは従来どおり配列を返す (limit のみ有効)
+type LivestreamPage struct {
+	Livestreams []Livestream `json:"livestreams"`
+	NextCursor  string       `json:"next_cursor,omitempty"`
+}
+
+type pageParams struct {
+	Paginate bool
+	// このIDより小さい配信を返す。0なら先頭から
+	BeforeID int64
+	// 負なら制限しない
+	Limit int
+}
+
+// cursor は直前のページの最後の配信IDを不透明な文字列にしたもの
+func encodeCursor(livestreamID int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("l:" + strconv.FormatInt(livestreamID, 10)))
+}
+
+func decodeCursor(cursor string) (int64, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, false
+	}
+	v, ok := strings.CutPrefix(string(b), "l:")
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+func parsePageParams(c echo.Context) (pageParams, error) {
+	p := pageParams{Limit: -1}
+	if c.QueryParams().Has("cursor") {
+		p.Paginate = true
+		p.Limit = defaultPageLimit
+		if cursor := c.QueryParam("cursor"); cursor != "" {
+			id, ok := decodeCursor(cursor)
+			if !ok {
+				return p, echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+			}
+			p.BeforeID = id
+		}
+	}
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return p, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+		}
+		if limit < 0 || (p.Paginate && (limit == 0 || limit > maxPageLimit)) {
+			return p, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter is out of range")
+		}
+		p.Limit = limit
+	}
+	return p, nil
+}
+
+// IDの降順に並んだ配信からページを切り出す
+// cursor なしで limit だけのときも同じ順で切り詰めるので、呼び出し側で降順に並べておく
+func (p pageParams) apply(livestreamModels []LivestreamModel) ([]LivestreamModel, string) {
+	if p.BeforeID > 0 {
+		i := 0
+		for i < len(livestreamModels) && livestreamModels[i].ID >= p.BeforeID {
+			i++
+		}
+		livestreamModels = livestreamModels[i:]
+	}
+	if p.Limit < 0 || len(livestreamModels) <= p.Limit {
+		return livestreamModels, ""
+	}
+	livestreamModels = livestreamModels[:p.Limit]
+	if !p.Paginate {
+		return livestreamModels, ""
+	}
+	return livestreamModels, encodeCursor(livestreamModels[len(livestreamModels)-1].ID)
+}
+
+func (p pageParams) respond(c echo.Context, livestreams []Livestream, nextCursor string) error {
+	if !p.Paginate {
+		return c.JSON(http.StatusOK, livestreams)
+	}
+	return c.JSON(http.StatusOK, &LivestreamPage{
+		Livestreams: livestreams,
+		NextCursor:  nextCursor,
+	})
+}
+
+// ライブコメント・リアクションの差分取得
+// since_id / before_id のどちらかを付けたリクエストにだけ newest_id / oldest_id 付きの形で返す
+type idWindowParams struct {
+	Windowed bool
+	// このIDより大きいものを返す
+	SinceID int64
+	// このIDより小さいものを返す。0なら制限しない
+	BeforeID int64
+	// 負なら制限しない
+	Limit int
+}
+
+func parseIDParam(c echo.Context, name string) (int64, bool, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return 0, false, nil
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || id < 0 {
+		return 0, false, echo.NewHTTPError(http.StatusBadRequest, name+" query parameter must be non-negative integer")
+	}
+	return id, true, nil
+}
+
+func parseIDWindowParams(c echo.Context) (idWindowParams, error) {
+	p := idWindowParams{Limit: -1}
+	sinceID, hasSince, err := parseIDParam(c, "since_id")
+	if err != nil {
+		return p, err
+	}
+	beforeID, hasBefore, err := parseIDParam(c, "before_id")
+	if err != nil {
+		return p, err
+	}
+	p.Windowed = hasSince || hasBefore
+	p.SinceID = sinceID
+	p.BeforeID = beforeID
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return p, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+		}
+		if limit < 0 {
+			return p, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter is out of range")
+		}
+		p.Limit = limit
+	}
+	return p, nil
+}
+
+// since_id だけのときは取りこぼさないよう古い方から limit 件取る
+func (p idWindowParams) ascending() bool {
+	return p.SinceID > 0 && p.BeforeID == 0 && p.Limit >= 0
+}
+
+// livestream_id で絞った table の行を ID の降順で取るクエリ
+// 古い方から取ったときは、呼び出し側で降順に戻す
+func (p idWindowParams) query(table string, livestreamID int64) (string, []any, bool) {
+	query := "SELECT * FROM " + table + " WHERE livestream_id = ?"
+	args := []any{livestreamID}
+	if p.SinceID > 0 {
+		query += " AND id > ?"
+		args = append(args, p.SinceID)
+	}
+	if p.BeforeID > 0 {
+		query += " AND id < ?"
+		args = append(args, p.BeforeID)
+	}
+	ascending := p.ascending()
+	if ascending {
+		query += " ORDER BY id"
+	} else {
+		query += " ORDER BY id DESC"
+	}
+	if p.Limit >= 0 {
+		query += " LIMIT ?"
+		args = append(args, p.Limit)
+	}
+	return query, args, ascending
+}
+
+// 降順に並んだ結果の端のID。空なら指定された境界をそのまま返し、次のリクエストに使えるようにする
+func (p idWindowParams) bounds(ids []int64) (newestID, oldestID int64) {
+	if len(ids) == 0 {
+		return p.SinceID, p.BeforeID
+	}
+	return ids[0], ids[len(ids)-1]
+}
+
+// embed=none のときは配信をトップレベルに一度だけ載せ、各要素は livestream_id で参照させる
+// 省略時と embed=livestream は従来どおり要素ごとに配信を埋め込む
+func parseEmbedLivestream(c echo.Context) (bool, error) {
+	switch c.QueryParam("embed") {
+	case "", "livestream":
+		return true, nil
+	case "none":
+		return false, nil
+	}
+	return false, echo.NewHTTPError(http.StatusBadRequest, "embed query parameter must be livestream or none")
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
 
@@ -27,6 +27,40 @@ type Reaction struct {
 	CreatedAt  int64      `json:"created_at"`
 }
 
+// since_id / before_id を付けたときのレスポンス
+type ReactionPage struct {
+	Reactions []Reaction `json:"reactions"`
+	NewestID  int64      `json:"newest_id"`
+	OldestID  int64      `json:"oldest_id"`
+}
+
+// 配信を埋め込まないリアクション
+type SlimReaction struct {
+	ID           int64  `json:"id"`
+	EmojiName    string `json:"emoji_name"`
+	User         User   `json:"user"`
+	LivestreamID int64  `json:"livestream_id"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// embed=none のときのレスポンス
+type SlimReactionPage struct {
+	Livestream Livestream     `json:"livestream"`
+	Reactions  []SlimReaction `json:"reactions"`
+	NewestID   int64          `json:"newest_id"`
+	OldestID   int64          `json:"oldest_id"`
+}
+
+func (r Reaction) slim() SlimReaction {
+	return SlimReaction{
+		ID:           r.ID,
+		EmojiName:    r.EmojiName,
+		User:         r.User,
+		LivestreamID: r.Livestream.ID,
+		CreatedAt:    r.CreatedAt,
+	}
+}
+
 type PostReactionRequest struct {
 	EmojiName string `json:"emoji_name"`
 }
@@ -44,23 +78,27 @@ func getReactionsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	query := "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY id DESC"
-	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
-		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
+	livestreamModel, exists := getLivestreamByID(int64(livestreamID))
+	if !exists {
+		return errLivestreamNotFound(int64(livestreamID))
+	}
+
+	window, err := parseIDWindowParams(c)
+	if err != nil {
+		return err
+	}
+	embedLivestream, err := parseEmbedLivestream(c)
+	if err != nil {
+		return err
 	}
+	query, args, ascending := window.query("reactions", livestreamModel.ID)
 
 	reactionModels := []ReactionModel{}
-	if err := dbConn.SelectContext(ctx, &reactionModels, query, livestreamID); err != nil {
+	if err := dbConn.SelectContext(ctx, &reactionModels, query, args...); err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, "failed to get reactions")
 	}
-
-	livestreamModel, exists := getLivestreamByID(int64(livestreamID))
-	if !exists {
-		return fmt.Errorf("livestream %d not found", livestreamID)
+	if ascending {
+		slices.Reverse(reactionModels)
 	}
 
 	userIDs := []int64{livestreamModel.UserID}
@@ -86,7 +124,31 @@ func getReactionsHandler(c echo.Context) error {
 		reactions[i] = reaction
 	}
 
-	return c.JSON(http.StatusOK, reactions)
+	if embedLivestream && !window.Windowed {
+		return c.JSON(http.StatusOK, reactions)
+	}
+	ids := make([]int64, len(reactionModels))
+	for i := range reactionModels {
+		ids[i] = reactionModels[i].ID
+	}
+	newestID, oldestID := window.bounds(ids)
+	if !embedLivestream {
+		slimReactions := make([]SlimReaction, len(reactions))
+		for i := range reactions {
+			slimReactions[i] = reactions[i].slim()
+		}
+		return c.JSON(http.StatusOK, &SlimReactionPage{
+			Livestream: livestream,
+			Reactions:  slimReactions,
+			NewestID:   newestID,
+			OldestID:   oldestID,
+		})
+	}
+	return c.JSON(http.StatusOK, &ReactionPage{
+		Reactions: reactions,
+		NewestID:  newestID,
+		OldestID:  oldestID,
+	})
 }
 
 func postReactionHandler(c echo.Context) error {
@@ -109,54 +171,74 @@ func postReactionHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
+	reaction, err := createReaction(ctx, userID, int64(livestreamID), req)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, reaction)
+}
+
+// リアクションを登録して、配信の購読者に流す
+// WebSocket からの投稿でも使う
+func createReaction(ctx context.Context, userID, livestreamID int64, req *PostReactionRequest) (Reaction, error) {
+	livestreamModel, exists := getLivestreamByID(livestreamID)
+	if !exists {
+		return Reaction{}, errLivestreamNotFound(livestreamID)
+	}
+	if err := livestreamStatusConfig.checkOpen(livestreamModel, time.Now()); err != nil {
+		return Reaction{}, err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil) // post
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
 	reactionModel := ReactionModel{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
+		UserID:       userID,
+		LivestreamID: livestreamID,
 		EmojiName:    req.EmojiName,
 		CreatedAt:    time.Now().Unix(),
 	}
 
 	result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
 	}
 
 	reactionID, err := result.LastInsertId()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
 	}
 	reactionModel.ID = reactionID
 
-	livestreamModel, exists := getLivestreamByID(int64(livestreamID))
-	if !exists {
-		return fmt.Errorf("livestream %d not found", livestreamID)
-	}
-
 	userIDs := []int64{reactionModel.UserID, livestreamModel.UserID}
 	userMap, err := getUserMap(ctx, tx, userIDs)
 	if err != nil {
-		return err
+		return Reaction{}, err
 	}
 	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel, userMap)
 	if err != nil {
-		return err
+		return Reaction{}, err
 	}
 	reaction, err := fillReactionResponse(ctx, tx, reactionModel, livestream, userMap)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusCreated, reaction)
+	livestreamEvents.Publish(livestreamID, LivestreamEvent{
+		ID:   reaction.ID,
+		Type: livestreamEventReaction,
+		Data: reaction,
+	})
+
+	return reaction, nil
 }
 
 func fillReactionResponse(ctx context.Context, tx dbtx, reactionModel ReactionModel, livestream Livestream, usermap map[int64]UserModel) (Reaction, error) {
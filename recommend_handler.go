@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultRecommendLimit = 20
+	maxRecommendLimit     = 100
+)
+
+// 行動ごとの重み。コメントは視聴やリアクションより強い興味とみなす
+var recommendSignals = []struct {
+	query  string
+	weight float64
+}{
+	{"SELECT livestream_id FROM livestream_viewers_history WHERE user_id = ?", 1},
+	{"SELECT livestream_id FROM livecomments WHERE user_id = ?", 2},
+	{"SELECT livestream_id FROM reactions WHERE user_id = ?", 1},
+}
+
+type recommendCandidate struct {
+	livestream LivestreamModel
+	score      float64
+}
+
+// ユーザーが興味を持ったタグと配信者の重み
+func getUserInterests(ctx context.Context, userID int64) (map[int64]float64, map[int64]float64, error) {
+	tagWeights := map[int64]float64{}
+	streamerWeights := map[int64]float64{}
+	for _, signal := range recommendSignals {
+		var livestreamIDs []int64
+		if err := dbConn.SelectContext(ctx, &livestreamIDs, signal.query, userID); err != nil {
+			return nil, nil, err
+		}
+		for _, l := range getLivestreamByIDs(livestreamIDs) {
+			if l.ID == 0 {
+				continue
+			}
+			streamerWeights[l.UserID] += signal.weight
+			for _, tagID := range rawTagIDs(l.RawTags) {
+				tagWeights[tagID] += signal.weight
+			}
+		}
+	}
+	return tagWeights, streamerWeights, nil
+}
+
+// 配信者ごとのスコア(livestream_score の合計)
+func getStreamerPopularity(ctx context.Context) (map[int64]int64, error) {
+	var scores []ScoreModel
+	if err := dbConn.SelectContext(ctx, &scores, `SELECT user_id AS id, SUM(score) AS score FROM livestream_score GROUP BY user_id`); err != nil {
+		return nil, err
+	}
+	popularity := make(map[int64]int64, len(scores))
+	for _, s := range scores {
+		popularity[s.ID] = s.Score
+	}
+	return popularity, nil
+}
+
+// おすすめ配信API
+// 配信中・配信予定の配信を、視聴・コメント・リアクションした配信のタグと配信者、配信者の人気で並べる
+// 行動履歴がないユーザーには人気順で返す
+// GET /api/livestream/recommended
+func getRecommendedLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	sess := getSession(c)
+	userID := sess.Values.UserID
+
+	limit := defaultRecommendLimit
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 || l > maxRecommendLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter is out of range")
+		}
+		limit = l
+	}
+
+	tagWeights, streamerWeights, err := getUserInterests(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user interests: "+err.Error())
+	}
+	popularity, err := getStreamerPopularity(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get streamer popularity: "+err.Error())
+	}
+
+	// 重みを正規化して、興味と人気を同じくらいの大きさで足し合わせる
+	var maxTagWeight, maxStreamerWeight, maxPopularity float64
+	for _, w := range tagWeights {
+		maxTagWeight = max(maxTagWeight, w)
+	}
+	for _, w := range streamerWeights {
+		maxStreamerWeight = max(maxStreamerWeight, w)
+	}
+	for _, p := range popularity {
+		maxPopularity = max(maxPopularity, math.Log1p(float64(p)))
+	}
+
+	now := time.Now().Unix()
+	candidates := []recommendCandidate{}
+	for _, l := range searchLivestreams(LivestreamSearchQuery{}) {
+		if l.UserID == userID || livestreamStatus(l, now) == livestreamStatusEnded {
+			continue
+		}
+		score := 0.0
+		if maxTagWeight > 0 {
+			for _, tagID := range rawTagIDs(l.RawTags) {
+				score += tagWeights[tagID] / maxTagWeight
+			}
+		}
+		if maxStreamerWeight > 0 {
+			score += streamerWeights[l.UserID] / maxStreamerWeight
+		}
+		if maxPopularity > 0 {
+			score += math.Log1p(float64(popularity[l.UserID])) / maxPopularity
+		}
+		candidates = append(candidates, recommendCandidate{livestream: l, score: score})
+	}
+	// 同点なら早く始まるものを先にする
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].livestream.StartAt < candidates[j].livestream.StartAt
+	})
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+
+	userIDs := make([]int64, len(candidates))
+	for i, r := range candidates {
+		userIDs[i] = r.livestream.UserID
+	}
+	userMap, err := getUserMap(ctx, dbConn, userIDs)
+	if err != nil {
+		return err
+	}
+	livestreams := make([]Livestream, len(candidates))
+	for i, r := range candidates {
+		livestream, err := fillLivestreamResponse(ctx, dbConn, r.livestream, userMap)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestreams[i] = livestream
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
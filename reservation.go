@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	reservationTermsEnvKey        = "ISUCON13_RESERVATION_TERMS"
+	reservationEpochEnvKey        = "ISUCON13_RESERVATION_EPOCH"
+	reservationSlotSecondsEnvKey  = "ISUCON13_RESERVATION_SLOT_SECONDS"
+	reservationSlotCapacityEnvKey = "ISUCON13_RESERVATION_SLOT_CAPACITY"
+	reservationMinDurationEnvKey  = "ISUCON13_RESERVATION_MIN_DURATION"
+	reservationMaxDurationEnvKey  = "ISUCON13_RESERVATION_MAX_DURATION"
+	reservationRejectPastEnvKey   = "ISUCON13_RESERVATION_REJECT_PAST"
+)
+
+// 繰り返し予約の最大回数
+const maxRecurrenceOccurrences = 100
+
+// 繰り返し予約のルール。count か until (unixtime) のどちらかで終わりを決める
+type RecurrenceRule struct {
+	// daily or weekly
+	Frequency string `json:"frequency"`
+	// 何日(週)おきか。省略時は1
+	Interval int64 `json:"interval"`
+	Count    int64 `json:"count"`
+	Until    int64 `json:"until"`
+}
+
+type Occurrence struct {
+	StartAt int64
+	EndAt   int64
+}
+
+type ReservationTerm struct {
+	StartAt time.Time
+	EndAt   time.Time
+}
+
+type ReservationConfig struct {
+	// reservation_slots.id の基準時刻。id=1 の枠が Epoch から始まる
+	Epoch       int64
+	SlotSeconds int64
+	// 新しく作る枠の予約可能数
+	SlotCapacity int64
+	Terms        []ReservationTerm
+	// 配信時間の下限・上限。0なら制限しない
+	MinDuration time.Duration
+	MaxDuration time.Duration
+	// 開始時刻が過去の予約・日時変更と、開始済みの配信の取り消し・日時変更を拒否する
+	// 予約期間が過去に固定されているベンチマーク環境では無効にしておく
+	RejectPastStart bool
+}
+
+// 2023/11/25 10:00からの１年間、1時間単位で5枠
+var reservationConfig = ReservationConfig{
+	Epoch:        1700874000,
+	SlotSeconds:  3600,
+	SlotCapacity: 5,
+	Terms: []ReservationTerm{
+		{
+			StartAt: time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC),
+			EndAt:   time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC),
+		},
+	},
+}
+
+// ISUCON13_RESERVATION_TERMS は "開始/終了" をカンマ区切りで並べたもの (RFC3339)
+// 例: 2023-11-25T01:00:00Z/2024-11-25T01:00:00Z,2024-11-25T01:00:00Z/2025-11-25T01:00:00Z
+func parseReservationTerms(v string) ([]ReservationTerm, error) {
+	terms := []ReservationTerm{}
+	for _, t := range strings.Split(v, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		start, end, ok := strings.Cut(t, "/")
+		if !ok {
+			return nil, fmt.Errorf("reservation term must be start/end: %s", t)
+		}
+		startAt, err := time.Parse(time.RFC3339, start)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse reservation term start %s: %w", start, err)
+		}
+		endAt, err := time.Parse(time.RFC3339, end)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse reservation term end %s: %w", end, err)
+		}
+		if !startAt.Before(endAt) {
+			return nil, fmt.Errorf("reservation term start must be before end: %s", t)
+		}
+		terms = append(terms, ReservationTerm{StartAt: startAt, EndAt: endAt})
+	}
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("no reservation term in %s", v)
+	}
+	return terms, nil
+}
+
+func loadReservationConfig() error {
+	conf := reservationConfig
+	if v, ok := os.LookupEnv(reservationTermsEnvKey); ok {
+		terms, err := parseReservationTerms(v)
+		if err != nil {
+			return err
+		}
+		conf.Terms = terms
+	}
+	if v, ok := os.LookupEnv(reservationEpochEnvKey); ok {
+		epoch, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as int: %+v", reservationEpochEnvKey, err)
+		}
+		conf.Epoch = epoch
+	}
+	if v, ok := os.LookupEnv(reservationSlotSecondsEnvKey); ok {
+		sec, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || sec <= 0 {
+			return fmt.Errorf("environment variable '%s' must be positive integer: %s", reservationSlotSecondsEnvKey, v)
+		}
+		conf.SlotSeconds = sec
+	}
+	if v, ok := os.LookupEnv(reservationSlotCapacityEnvKey); ok {
+		capacity, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || capacity < 0 {
+			return fmt.Errorf("environment variable '%s' must be non-negative integer: %s", reservationSlotCapacityEnvKey, v)
+		}
+		conf.SlotCapacity = capacity
+	}
+	if v, ok := os.LookupEnv(reservationMinDurationEnvKey); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as duration: %+v", reservationMinDurationEnvKey, err)
+		}
+		conf.MinDuration = d
+	}
+	if v, ok := os.LookupEnv(reservationMaxDurationEnvKey); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as duration: %+v", reservationMaxDurationEnvKey, err)
+		}
+		conf.MaxDuration = d
+	}
+	if v, ok := os.LookupEnv(reservationRejectPastEnvKey); ok {
+		reject, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", reservationRejectPastEnvKey, err)
+		}
+		conf.RejectPastStart = reject
+	}
+	if conf.MaxDuration > 0 && conf.MinDuration > conf.MaxDuration {
+		return fmt.Errorf("%s must not be greater than %s", reservationMinDurationEnvKey, reservationMaxDurationEnvKey)
+	}
+	reservationConfig = conf
+	return nil
+}
+
+// 予約区間がいずれかの予約期間にかかっているか
+func (conf ReservationConfig) inTerm(startAt, endAt int64) bool {
+	reserveStartAt := time.Unix(startAt, 0)
+	reserveEndAt := time.Unix(endAt, 0)
+	for _, term := range conf.Terms {
+		if reserveStartAt.Before(term.EndAt) && reserveEndAt.After(term.StartAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// 配信時間帯の検証
+// 開始済みの配信は取り消し・日時変更させない (RejectPastStart が有効なときだけ)
+func (conf ReservationConfig) checkNotStarted(livestreamModel LivestreamModel, now time.Time) error {
+	if conf.RejectPastStart && livestreamModel.StartAt <= now.Unix() {
+		return newConflictError("livestream %d has already started", livestreamModel.ID)
+	}
+	return nil
+}
+
+func (conf ReservationConfig) validateSchedule(verr *ValidationError, startAt, endAt int64, now time.Time) {
+	if conf.RejectPastStart && startAt < now.Unix() {
+		verr.Add("start_at", "start_at must not be in the past")
+	}
+	if endAt <= startAt {
+		verr.Add("end_at", "end_at must be after start_at")
+		return
+	}
+	duration := time.Duration(endAt-startAt) * time.Second
+	if conf.MinDuration > 0 && duration < conf.MinDuration {
+		verr.Add("end_at", fmt.Sprintf("livestream must be at least %s", conf.MinDuration))
+	}
+	if conf.MaxDuration > 0 && duration > conf.MaxDuration {
+		verr.Add("end_at", fmt.Sprintf("livestream must be at most %s", conf.MaxDuration))
+	}
+	if !conf.inTerm(startAt, endAt) {
+		verr.Add("start_at", "bad reservation time range")
+	}
+}
+
+func validateTagIDs(verr *ValidationError, tagIDs []int64) {
+	seen := map[int64]struct{}{}
+	for _, tagID := range tagIDs {
+		if _, ok := getTagByID(tagID); !ok {
+			verr.Add("tags", fmt.Sprintf("tag %d does not exist", tagID))
+			return
+		}
+		if isTagRetired(tagID) {
+			verr.Add("tags", fmt.Sprintf("tag %d is retired", tagID))
+			return
+		}
+		if _, ok := seen[tagID]; ok {
+			verr.Add("tags", fmt.Sprintf("tag %d is duplicated", tagID))
+			return
+		}
+		seen[tagID] = struct{}{}
+	}
+}
+
+func (req *ReserveLivestreamRequest) validate(now time.Time, ownerID int64) error {
+	verr := &ValidationError{}
+	reservationConfig.validateSchedule(verr, req.StartAt, req.EndAt, now)
+	validateTagIDs(verr, req.Tags)
+	validateCollaboratorIDs(verr, ownerID, req.Collaborators)
+	mediaURLConfig.validatePlaylistURL(verr, req.PlaylistUrl)
+	mediaURLConfig.validateThumbnailURL(verr, req.ThumbnailUrl)
+	if req.Recurrence != nil {
+		req.Recurrence.validate(verr, req.StartAt)
+		if req.Waitlist {
+			verr.Add("waitlist", "waitlist can't be used with recurrence")
+		}
+	}
+	return verr.Err()
+}
+
+func (r *RecurrenceRule) step() int64 {
+	step := max(r.Interval, 1) * 24 * 60 * 60
+	if r.Frequency == "weekly" {
+		step *= 7
+	}
+	return step
+}
+
+func (r *RecurrenceRule) validate(verr *ValidationError, startAt int64) {
+	if r.Frequency != "daily" && r.Frequency != "weekly" {
+		verr.Add("recurrence.frequency", "frequency must be daily or weekly")
+		return
+	}
+	if r.Interval < 0 {
+		verr.Add("recurrence.interval", "interval must be positive")
+	}
+	if (r.Count == 0) == (r.Until == 0) {
+		verr.Add("recurrence", "either count or until must be specified")
+		return
+	}
+	if r.Count < 0 || r.Count > maxRecurrenceOccurrences {
+		verr.Add("recurrence.count", fmt.Sprintf("count must be between 1 and %d", maxRecurrenceOccurrences))
+	}
+	if r.Until != 0 {
+		if r.Until < startAt {
+			verr.Add("recurrence.until", "until must not be before start_at")
+		} else if (r.Until-startAt)/r.step()+1 > maxRecurrenceOccurrences {
+			verr.Add("recurrence.until", fmt.Sprintf("recurrence must not exceed %d occurrences", maxRecurrenceOccurrences))
+		}
+	}
+}
+
+// 最初の配信を含む全ての回
+func (r *RecurrenceRule) occurrences(startAt, endAt int64) []Occurrence {
+	step := r.step()
+	occurrences := []Occurrence{}
+	for i := int64(0); i < maxRecurrenceOccurrences; i++ {
+		if r.Count > 0 && i >= r.Count {
+			break
+		}
+		offset := i * step
+		if r.Until > 0 && startAt+offset > r.Until {
+			break
+		}
+		occurrences = append(occurrences, Occurrence{StartAt: startAt + offset, EndAt: endAt + offset})
+	}
+	return occurrences
+}
+
+// 予約区間に対応する reservation_slots.id の範囲
+func (conf ReservationConfig) slotIDRange(startAt, endAt int64) (int64, int64) {
+	startIndex := math.Ceil(float64(startAt-conf.Epoch) / float64(conf.SlotSeconds))
+	endIndex := math.Floor(float64(endAt-conf.Epoch) / float64(conf.SlotSeconds))
+	return int64(startIndex), int64(endIndex)
+}
+
+// startAt から始まる枠の reservation_slots.id
+func (conf ReservationConfig) slotID(startAt int64) int64 {
+	return (startAt-conf.Epoch)/conf.SlotSeconds + 1
+}
+
+// 予約期間 [from, to) の枠を reservation_slots に作る
+// 既にある枠は予約状況を保つためそのままにする
+func generateReservationSlots(ctx context.Context, conf ReservationConfig, from, to time.Time) (int64, error) {
+	const bulkSize = 1000
+
+	start := max(from.Unix(), conf.Epoch)
+	if r := (start - conf.Epoch) % conf.SlotSeconds; r != 0 {
+		// 枠の境界に揃える
+		start += conf.SlotSeconds - r
+	}
+
+	var created int64
+	values := []string{}
+	params := []any{}
+	flush := func() error {
+		if len(values) == 0 {
+			return nil
+		}
+		query := `INSERT IGNORE INTO reservation_slots (id, slot, start_at, end_at) VALUES ` + strings.Join(values, ", ")
+		rs, err := dbConn.ExecContext(ctx, query, params...)
+		if err != nil {
+			return err
+		}
+		n, err := rs.RowsAffected()
+		if err != nil {
+			return err
+		}
+		created += n
+		values = values[:0]
+		params = params[:0]
+		return nil
+	}
+
+	for t := start; t+conf.SlotSeconds <= to.Unix(); t += conf.SlotSeconds {
+		values = append(values, "(?, ?, ?, ?)")
+		params = append(params, conf.slotID(t), conf.SlotCapacity, t, t+conf.SlotSeconds)
+		if len(values) >= bulkSize {
+			if err := flush(); err != nil {
+				return created, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return created, err
+	}
+	return created, nil
+}
+
+// isupipe reservation-slots [-from RFC3339 -to RFC3339]
+// 予約期間を追加・延長したときに reservation_slots の行を作る
+// 期間を指定しなければ設定されている全ての予約期間について作る
+func runReservationSlotsCommand(args []string) error {
+	fs := flag.NewFlagSet("reservation-slots", flag.ContinueOnError)
+	from := fs.String("from", "", "start of the term (RFC3339)")
+	to := fs.String("to", "", "end of the term (RFC3339)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := loadReservationConfig(); err != nil {
+		return err
+	}
+	terms := reservationConfig.Terms
+	if *from != "" || *to != "" {
+		ts, err := parseReservationTerms(*from + "/" + *to)
+		if err != nil {
+			return err
+		}
+		terms = ts
+	}
+
+	conn, err := connectDB(nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect db: %w", err)
+	}
+	defer conn.Close()
+	dbConn = conn
+
+	ctx := context.Background()
+	for _, term := range terms {
+		created, err := generateReservationSlots(ctx, reservationConfig, term.StartAt, term.EndAt)
+		if err != nil {
+			return fmt.Errorf("failed to generate reservation_slots for %s - %s: %w", term.StartAt.Format(time.RFC3339), term.EndAt.Format(time.RFC3339), err)
+		}
+		fmt.Printf("%s - %s: %d slots created\n", term.StartAt.Format(time.RFC3339), term.EndAt.Format(time.RFC3339), created)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	serverEngineEnvKey = "ISUCON13_SERVER_ENGINE"
+	streamingEnvKey    = "ISUCON13_STREAMING"
+	listenAddrEnvKey   = "ISUCON13_LISTEN_ADDRESS"
+	shutdownTimeout    = 10 * time.Second
+)
+
+// httpServer はechoで組み立てたルータを待ち受けるサーバ
+// ハンドラはecho.HandlerFuncで一度だけ書き、どのエンジンでも同じルーティング・ミドルウェアを通る
+type httpServer interface {
+	Serve(ln net.Listener) error
+	Shutdown(ctx context.Context) error
+}
+
+// net/httpでそのまま待ち受ける
+type netHTTPServer struct {
+	srv *http.Server
+}
+
+func (s *netHTTPServer) Serve(ln net.Listener) error {
+	if err := s.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *netHTTPServer) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+// fasthttp(fiber)で受けてechoのルータに渡す
+type fiberServer struct {
+	app *fiber.App
+}
+
+func (s *fiberServer) Serve(ln net.Listener) error {
+	return s.app.Listener(ln)
+}
+
+func (s *fiberServer) Shutdown(ctx context.Context) error {
+	return s.app.ShutdownWithContext(ctx)
+}
+
+// SSE・WebSocketのルートを登録するか (デフォルトは有効)
+var streamingEnabled = true
+
+func loadStreamingConfig() error {
+	if v, ok := os.LookupEnv(streamingEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", streamingEnvKey, err)
+		}
+		streamingEnabled = enabled
+	}
+	return nil
+}
+
+func newHTTPServer(engine string, h http.Handler) (httpServer, error) {
+	switch engine {
+	case "", "echo", "nethttp":
+		return &netHTTPServer{srv: &http.Server{Handler: h}}, nil
+	case "fiber":
+		// adaptor 経由では Flush が効かず Hijack もできないので、SSE は送られず WebSocket は繋がらない
+		// SSE・WebSocket を使うときは net/http で待ち受ける
+		if streamingEnabled {
+			return nil, fmt.Errorf("server engine fiber can't serve SSE/WebSocket routes; set %s=false to use it", streamingEnvKey)
+		}
+		app := fiber.New(fiber.Config{
+			DisableDefaultDate:    true,
+			DisableStartupMessage: true,
+		})
+		app.Use(adaptor.HTTPHandler(h))
+		return &fiberServer{app: app}, nil
+	}
+	return nil, fmt.Errorf("unknown server engine: %s", engine)
+}
+
+func listenAddress() string {
+	if v, ok := os.LookupEnv(listenAddrEnvKey); ok {
+		return v
+	}
+	return net.JoinHostPort("", strconv.Itoa(listenPort))
+}
+
+// serve はctxがキャンセルされるまで待ち受け、その後graceful shutdownする
+func serve(ctx context.Context, e *echo.Echo) error {
+	srv, err := newHTTPServer(os.Getenv(serverEngineEnvKey), e)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", listenAddress())
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	return <-errCh
+}
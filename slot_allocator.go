@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+)
+
+// 予約枠の残数をメモリ上のセグメント木(区間加算・区間最小)で持つ
+// 予約可否の判定と枠の確保をロック1つ・O(log n)で行い、DBの行ロックを待たない
+// DBへの反映は判定後の短いトランザクションで行い、失敗したら枠を戻す
+type slotAllocator struct {
+	mu sync.Mutex
+	// 先頭の枠の reservation_slots.id
+	base int64
+	n    int
+	mins []int64
+	lazy []int64
+	// 枠ごとの時刻。枠がないidは exists=false
+	startAt []int64
+	endAt   []int64
+	exists  []bool
+}
+
+// 枠がないidの残数。SQLのMIN(slot)と同じく、存在しない枠は判定に影響させない
+// 確保・解放で多少増減するので、missingSlot/2 以上を枠なしとみなす
+const missingSlot = math.MaxInt64 / 2
+
+var reservationSlots = &slotAllocator{}
+
+// reservation_slots の行から木を作り直す
+func (a *slotAllocator) Reset(slots []ReservationSlotModel) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.base, a.n = 0, 0
+	a.mins, a.lazy = nil, nil
+	a.startAt, a.endAt, a.exists = nil, nil, nil
+	if len(slots) == 0 {
+		return
+	}
+	lo, hi := slots[0].ID, slots[0].ID
+	for _, s := range slots {
+		lo = min(lo, s.ID)
+		hi = max(hi, s.ID)
+	}
+	a.base = lo
+	a.n = int(hi-lo) + 1
+	a.startAt = make([]int64, a.n)
+	a.endAt = make([]int64, a.n)
+	a.exists = make([]bool, a.n)
+	values := make([]int64, a.n)
+	for i := range values {
+		values[i] = missingSlot
+	}
+	for _, s := range slots {
+		i := s.ID - lo
+		values[i] = s.Slot
+		a.startAt[i] = s.StartAt
+		a.endAt[i] = s.EndAt
+		a.exists[i] = true
+	}
+	a.mins = make([]int64, 4*a.n)
+	a.lazy = make([]int64, 4*a.n)
+	a.build(1, 0, a.n-1, values)
+}
+
+func (a *slotAllocator) build(node, l, r int, values []int64) {
+	if l == r {
+		a.mins[node] = values[l]
+		return
+	}
+	m := (l + r) / 2
+	a.build(node*2, l, m, values)
+	a.build(node*2+1, m+1, r, values)
+	a.mins[node] = min(a.mins[node*2], a.mins[node*2+1])
+}
+
+func (a *slotAllocator) push(node int) {
+	if a.lazy[node] == 0 {
+		return
+	}
+	for _, child := range []int{node * 2, node*2 + 1} {
+		a.mins[child] += a.lazy[node]
+		a.lazy[child] += a.lazy[node]
+	}
+	a.lazy[node] = 0
+}
+
+func (a *slotAllocator) add(node, l, r, ql, qr int, v int64) {
+	if qr < l || r < ql {
+		return
+	}
+	if ql <= l && r <= qr {
+		a.mins[node] += v
+		a.lazy[node] += v
+		return
+	}
+	a.push(node)
+	m := (l + r) / 2
+	a.add(node*2, l, m, ql, qr, v)
+	a.add(node*2+1, m+1, r, ql, qr, v)
+	a.mins[node] = min(a.mins[node*2], a.mins[node*2+1])
+}
+
+func (a *slotAllocator) query(node, l, r, ql, qr int) int64 {
+	if qr < l || r < ql {
+		return missingSlot
+	}
+	if ql <= l && r <= qr {
+		return a.mins[node]
+	}
+	a.push(node)
+	m := (l + r) / 2
+	return min(a.query(node*2, l, m, ql, qr), a.query(node*2+1, m+1, r, ql, qr))
+}
+
+// 区間内で残数がlimit未満の枠をたどる
+func (a *slotAllocator) walk(node, l, r, ql, qr int, limit int64, fn func(i int, remaining int64)) {
+	if qr < l || r < ql || a.mins[node] >= limit {
+		return
+	}
+	if l == r {
+		fn(l, a.mins[node])
+		return
+	}
+	a.push(node)
+	m := (l + r) / 2
+	a.walk(node*2, l, m, ql, qr, limit, fn)
+	a.walk(node*2+1, m+1, r, ql, qr, limit, fn)
+}
+
+// idの範囲を木のインデックスに切り詰める
+func (a *slotAllocator) clip(startID, endID int64) (int, int, bool) {
+	if a.n == 0 {
+		return 0, 0, false
+	}
+	l := max(startID-a.base, 0)
+	r := min(endID-a.base, int64(a.n-1))
+	if l > r {
+		return 0, 0, false
+	}
+	return int(l), int(r), true
+}
+
+func (a *slotAllocator) slotModel(i int, remaining int64) ReservationSlotModel {
+	return ReservationSlotModel{
+		ID:      a.base + int64(i),
+		Slot:    remaining,
+		StartAt: a.startAt[i],
+		EndAt:   a.endAt[i],
+	}
+}
+
+// id が [startID, endID] の枠をすべて1つずつ確保する
+// 確保できなければ埋まっている枠を返す
+func (a *slotAllocator) Reserve(startID, endID int64) (bool, []ReservationSlotModel) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reserve(startID, endID)
+}
+
+func (a *slotAllocator) reserve(startID, endID int64) (bool, []ReservationSlotModel) {
+	l, r, ok := a.clip(startID, endID)
+	if !ok {
+		return false, []ReservationSlotModel{}
+	}
+	m := a.query(1, 0, a.n-1, l, r)
+	if m >= missingSlot/2 {
+		return false, []ReservationSlotModel{}
+	}
+	if m < 1 {
+		full := []ReservationSlotModel{}
+		a.walk(1, 0, a.n-1, l, r, 1, func(i int, remaining int64) {
+			full = append(full, a.slotModel(i, remaining))
+		})
+		return false, full
+	}
+	a.add(1, 0, a.n-1, l, r, -1)
+	return true, nil
+}
+
+type slotRange struct {
+	StartID int64
+	EndID   int64
+}
+
+type slotReservation struct {
+	OK        bool
+	FullSlots []ReservationSlotModel
+}
+
+// 複数の区間をそれぞれ確保する
+// allOrNothing なら1つでも確保できなかったときは何も確保しない
+func (a *slotAllocator) ReserveEach(ranges []slotRange, allOrNothing bool) []slotReservation {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	results := make([]slotReservation, len(ranges))
+	failed := false
+	for i, r := range ranges {
+		ok, full := a.reserve(r.StartID, r.EndID)
+		results[i] = slotReservation{OK: ok, FullSlots: full}
+		failed = failed || !ok
+	}
+	if failed && allOrNothing {
+		for i, r := range ranges {
+			if results[i].OK {
+				a.release(r.StartID, r.EndID)
+				results[i].OK = false
+			}
+		}
+	}
+	return results
+}
+
+// Reserve で確保した枠を戻す
+func (a *slotAllocator) Release(startID, endID int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.release(startID, endID)
+}
+
+func (a *slotAllocator) release(startID, endID int64) {
+	if l, r, ok := a.clip(startID, endID); ok {
+		a.add(1, 0, a.n-1, l, r, 1)
+	}
+}
+
+// r のうち other と重ならない部分
+func (r slotRange) subtract(other slotRange) []slotRange {
+	if other.EndID < r.StartID || r.EndID < other.StartID {
+		return []slotRange{r}
+	}
+	ranges := []slotRange{}
+	if r.StartID < other.StartID {
+		ranges = append(ranges, slotRange{StartID: r.StartID, EndID: other.StartID - 1})
+	}
+	if other.EndID < r.EndID {
+		ranges = append(ranges, slotRange{StartID: other.EndID + 1, EndID: r.EndID})
+	}
+	return ranges
+}
+
+// id が [startID, endID] に枠が1つでもあるか
+func (a *slotAllocator) HasSlots(startID, endID int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	l, r, ok := a.clip(startID, endID)
+	if !ok {
+		return false
+	}
+	return a.query(1, 0, a.n-1, l, r) < missingSlot/2
+}
+
+// id が [startID, endID] の枠の残数
+func (a *slotAllocator) Slots(startID, endID int64) []ReservationSlotModel {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	slots := []ReservationSlotModel{}
+	l, r, ok := a.clip(startID, endID)
+	if !ok {
+		return slots
+	}
+	a.walk(1, 0, a.n-1, l, r, missingSlot, func(i int, remaining int64) {
+		if a.exists[i] {
+			slots = append(slots, a.slotModel(i, remaining))
+		}
+	})
+	return slots
+}
+
+func warmupSlotAllocator(ctx context.Context) {
+	var slots []ReservationSlotModel
+	if err := dbConn.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots"); err != nil {
+		return
+	}
+	reservationSlots.Reset(slots)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	sseHeartbeatInterval = 15 * time.Second
+	// 再接続時に取り直すライブコメントの上限
+	sseMaxResumeLivecomments = 1000
+	// 取り直しきれないほど間が空いたときに送る。クライアントはRESTで取り直す
+	sseEventReset = "reset"
+)
+
+// reset イベントの中身。id には最新のコメントIDを付けるので、再接続するとここから続きを受け取る
+type SSEReset struct {
+	Reason   string `json:"reason"`
+	NewestID int64  `json:"newest_id"`
+}
+
+func writeSSE(c echo.Context, id int64, event string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.Response(), "id: %d\nevent: %s\ndata: %s\n\n", id, event, b); err != nil {
+		return err
+	}
+	c.Response().Flush()
+	return nil
+}
+
+// ライブコメントのSSE配信API
+// Last-Event-ID (初回は last_event_id クエリ) より後のコメントを送ってから、新しいコメントを流し続ける
+// 取り直すコメントが多すぎるときは reset イベントを送って閉じる
+// GET /api/livestream/:livestream_id/livecomment/stream
+func streamLivecommentsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	livestreamModel, exists := getLivestreamByID(int64(livestreamID))
+	if !exists {
+		return errLivestreamNotFound(int64(livestreamID))
+	}
+
+	lastID := int64(-1)
+	lastEventID := c.Request().Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.QueryParam("last_event_id")
+	}
+	if lastEventID != "" {
+		lastID, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Last-Event-ID must be integer")
+		}
+	}
+
+	// 取り直しの間に投稿されたコメントを落とさないよう、先に購読しておく
+	sub := livestreamEvents.Subscribe(livestreamModel.ID)
+	defer livestreamEvents.Unsubscribe(sub)
+
+	var livecomments []Livecomment
+	reset := false
+	if lastID >= 0 {
+		livecommentModels := []LivecommentModel{}
+		if err := dbConn.SelectContext(ctx, &livecommentModels, "SELECT * FROM livecomments WHERE livestream_id = ? AND id > ? ORDER BY id LIMIT ?", livestreamModel.ID, lastID, sseMaxResumeLivecomments+1); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+		}
+		if len(livecommentModels) > sseMaxResumeLivecomments {
+			reset = true
+			if err := dbConn.GetContext(ctx, &lastID, "SELECT IFNULL(MAX(id), 0) FROM livecomments WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get the latest livecomment: "+err.Error())
+			}
+		} else {
+			_, livecomments, err = fillLivecomments(ctx, livestreamModel, livecommentModels)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	// nginx でバッファリングさせない
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	if reset {
+		// 取りこぼしたまま続けず、RESTで取り直させてから閉じる
+		writeSSE(c, lastID, sseEventReset, &SSEReset{Reason: "too many missed livecomments", NewestID: lastID})
+		return nil
+	}
+
+	for _, livecomment := range livecomments {
+		if err := writeSSE(c, livecomment.ID, livestreamEventLivecomment, livecomment); err != nil {
+			return nil
+		}
+		lastID = livecomment.ID
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		case event, ok := <-sub.C:
+			if !ok {
+				// 受信が追いつかなかった。クライアントは Last-Event-ID で再接続する
+				return nil
+			}
+			if event.Type != livestreamEventLivecomment || event.ID <= lastID {
+				continue
+			}
+			if err := writeSSE(c, event.ID, event.Type, event.Data); err != nil {
+				return nil
+			}
+			lastID = event.ID
+		}
+	}
+}
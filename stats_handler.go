@@ -43,6 +43,7 @@ type UserStatistics struct {
 	TotalLivecomments int64  `json:"total_livecomments"`
 	TotalTip          int64  `json:"total_tip"`
 	FavoriteEmoji     string `json:"favorite_emoji"`
+	FollowerCount     int64  `json:"follower_count"`
 }
 
 type UserRankingEntry struct {
@@ -191,6 +192,7 @@ WHERE l.user_id = ?
 		TotalLivecomments: totalLivecomments,
 		TotalTip:          totalTip,
 		FavoriteEmoji:     favoriteEmoji,
+		FollowerCount:     getFollowerCount(user.ID),
 	}
 	return c.JSON(http.StatusOK, stats)
 }
@@ -241,6 +243,10 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	}
 	livestreamID := int64(id)
 
+	if _, exists := getLivestreamByID(livestreamID); !exists {
+		return errLivestreamNotFound(livestreamID)
+	}
+
 	// ランク算出
 	rank, err := getLivestreamRanking(livestreamID)
 	if err != nil {
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/goccy/go-json"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const adminUsernamesEnvKey = "ISUCON13_ADMIN_USERNAMES"
+
+// 初期データのタグ。IDは1から順に振られている
+// 管理APIで追加・変更したタグは /api/initialize でこの状態に戻す
+var seedTags = []string{"ライブ配信", "ゲーム実況", "生放送", "アドバイス", "初心者歓迎", "プロゲーマー", "新作ゲーム", "レトロゲーム", "RPG", "FPS", "アクションゲーム", "対戦ゲーム", "マルチプレイ", "シングルプレイ", "ゲーム解説", "ホラーゲーム", "イベント生放送", "新情報発表", "Q&Aセッション", "チャット交流", "視聴者参加", "音楽ライブ", "カバーソング", "オリジナル楽曲", "アコースティック", "歌配信", "楽器演奏", "ギター", "ピアノ", "バンドセッション", "DJセット", "トーク配信", "朝活", "夜ふかし", "日常話", "趣味の話", "語学学習", "お料理配信", "手料理", "レシピ紹介", "アート配信", "絵描き", "DIY", "手芸", "アニメトーク", "映画レビュー", "読書感想", "ファッション", "メイク", "ビューティー", "健康", "ワークアウト", "ヨガ", "ダンス", "旅行記", "アウトドア", "キャンプ", "ペットと一緒", "猫", "犬", "釣り", "ガーデニング", "テクノロジー", "ガジェット紹介", "プログラミング", "DIY電子工作", "ニュース解説", "歴史", "文化", "社会問題", "心理学", "宇宙", "科学", "マジック", "コメディ", "スポーツ", "サッカー", "野球", "バスケットボール", "ライフハック", "教育", "子育て", "ビジネス", "起業", "投資", "仮想通貨", "株式投資", "不動産", "キャリア", "スピリチュアル", "占い", "手相", "オカルト", "UFO", "都市伝説", "コンサート", "ファンミーティング", "コラボ配信", "記念配信", "生誕祭", "周年記念", "サプライズ", "椅子"}
+
+type TagAliasModel struct {
+	Alias string `db:"alias"`
+	TagID int64  `db:"tag_id"`
+}
+
+type CreateTagRequest struct {
+	Name     string   `json:"name"`
+	ParentID int64    `json:"parent_id"`
+	Aliases  []string `json:"aliases"`
+}
+
+// 指定されたフィールドだけを更新する
+type UpdateTagRequest struct {
+	Name     *string   `json:"name"`
+	ParentID *int64    `json:"parent_id"`
+	Aliases  *[]string `json:"aliases"`
+}
+
+// tags と tag_aliases をメモリに持つ
+// 廃止したタグも既存の配信の表示のために残すが、新しく付けることはできない
+var (
+	// タグの変更を1つずつ通す。DBを待つ間も tagLock の読み手は止めない
+	tagUpdateLock sync.Mutex
+	tagLock       sync.RWMutex
+	TagMap        = map[int64]Tag{}
+	// タグ名と別名からタグIDを引く
+	TagIDMap = map[string]int64{}
+	// 子タグのID
+	tagChildren = map[int64][]int64{}
+	retiredTags = map[int64]struct{}{}
+)
+
+// タグの管理者。カンマ区切りのユーザー名
+var adminUsernames = []string{}
+
+func loadAdminConfig() {
+	adminUsernames = []string{}
+	for _, name := range strings.Split(os.Getenv(adminUsernamesEnvKey), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			adminUsernames = append(adminUsernames, name)
+		}
+	}
+}
+
+func warmupTagCache(ctx context.Context) error {
+	tagUpdateLock.Lock()
+	defer tagUpdateLock.Unlock()
+	return reloadTagCache(ctx)
+}
+
+// tags を初期データに戻す
+func resetTags(ctx context.Context) error {
+	if _, err := dbConn.ExecContext(ctx, "TRUNCATE TABLE tags"); err != nil {
+		return err
+	}
+	tagModels := make([]TagModel, len(seedTags))
+	for i, name := range seedTags {
+		tagModels[i] = TagModel{ID: int64(i + 1), Name: name}
+	}
+	_, err := dbConn.NamedExecContext(ctx, "INSERT INTO tags (id, name, parent_id, retired) VALUES (:id, :name, :parent_id, :retired)", tagModels)
+	return err
+}
+
+// 新しいマップを組み立ててから、tagLock を取って差し替える
+func rebuildTagCache(tagModels []TagModel, aliasModels []TagAliasModel) {
+	tagMap := map[int64]Tag{}
+	tagIDMap := map[string]int64{}
+	children := map[int64][]int64{}
+	retired := map[int64]struct{}{}
+	for _, t := range tagModels {
+		tagMap[t.ID] = t.toTag()
+		tagIDMap[t.Name] = t.ID
+		if t.ParentID != 0 {
+			children[t.ParentID] = append(children[t.ParentID], t.ID)
+		}
+		if t.Retired {
+			retired[t.ID] = struct{}{}
+		}
+	}
+	for _, a := range aliasModels {
+		if _, ok := tagIDMap[a.Alias]; !ok {
+			tagIDMap[a.Alias] = a.TagID
+		}
+	}
+
+	tagLock.Lock()
+	defer tagLock.Unlock()
+	TagMap = tagMap
+	TagIDMap = tagIDMap
+	tagChildren = children
+	retiredTags = retired
+}
+
+func (m TagModel) toTag() Tag {
+	return Tag{
+		ID:       m.ID,
+		Name:     m.Name,
+		ParentID: m.ParentID,
+	}
+}
+
+func getTagByID(tagID int64) (Tag, bool) {
+	tagLock.RLock()
+	defer tagLock.RUnlock()
+	tag, ok := TagMap[tagID]
+	return tag, ok
+}
+
+// タグ名か別名からタグIDを引く
+func getTagIDByName(name string) (int64, bool) {
+	tagLock.RLock()
+	defer tagLock.RUnlock()
+	tagID, ok := TagIDMap[name]
+	return tagID, ok
+}
+
+func isTagRetired(tagID int64) bool {
+	tagLock.RLock()
+	defer tagLock.RUnlock()
+	_, ok := retiredTags[tagID]
+	return ok
+}
+
+// タグと、その子孫のタグのID
+func tagWithDescendants(tagID int64) []int64 {
+	tagLock.RLock()
+	defer tagLock.RUnlock()
+	tagIDs := []int64{}
+	queue := []int64{tagID}
+	seen := map[int64]struct{}{}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		tagIDs = append(tagIDs, id)
+		queue = append(queue, tagChildren[id]...)
+	}
+	return tagIDs
+}
+
+func verifyAdminSession(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+	sess := getSession(c)
+	user, ok := getUserByID(sess.Values.UserID)
+	if !ok || !slices.Contains(adminUsernames, user.Name) {
+		return newForbiddenError("only admins can manage tags")
+	}
+	return nil
+}
+
+// tagLock の読み取りロックを取ってから呼ぶ
+func validateTagName(verr *ValidationError, field, name string, tagID int64) {
+	if strings.TrimSpace(name) == "" {
+		verr.Add(field, "must not be empty")
+		return
+	}
+	if strings.Contains(name, ",") {
+		verr.Add(field, "must not contain comma")
+		return
+	}
+	if id, ok := TagIDMap[name]; ok && id != tagID {
+		verr.Add(field, name+" is already used")
+	}
+}
+
+// tagLock の読み取りロックを取ってから呼ぶ
+func validateTagAliases(verr *ValidationError, name string, aliases []string, tagID int64) {
+	seen := map[string]struct{}{name: {}}
+	for _, alias := range aliases {
+		if _, ok := seen[alias]; ok {
+			verr.Add("aliases", alias+" is duplicated")
+			return
+		}
+		seen[alias] = struct{}{}
+		validateTagName(verr, "aliases", alias, tagID)
+	}
+}
+
+// tagLock の読み取りロックを取ってから呼ぶ
+// 親をたどって自分に戻るなら循環している
+func validateTagParent(verr *ValidationError, parentID, tagID int64) {
+	if parentID == 0 {
+		return
+	}
+	for id, depth := parentID, 0; id != 0 && depth <= len(TagMap); depth++ {
+		parent, ok := TagMap[id]
+		if !ok {
+			verr.Add("parent_id", "parent tag does not exist")
+			return
+		}
+		if id == tagID {
+			verr.Add("parent_id", "tag hierarchy must not be cyclic")
+			return
+		}
+		id = parent.ParentID
+	}
+}
+
+func replaceTagAliases(ctx context.Context, tx sqlx.ExecerContext, tagID int64, aliases []string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tag_aliases WHERE tag_id = ?", tagID); err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO tag_aliases (alias, tag_id) VALUES (?, ?)", alias, tagID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagUpdateLock を取ってから呼ぶ
+func reloadTagCache(ctx context.Context) error {
+	var tagModels []TagModel
+	if err := dbConn.SelectContext(ctx, &tagModels, "SELECT * FROM tags"); err != nil {
+		return err
+	}
+	var aliasModels []TagAliasModel
+	if err := dbConn.SelectContext(ctx, &aliasModels, "SELECT * FROM tag_aliases"); err != nil {
+		return err
+	}
+	rebuildTagCache(tagModels, aliasModels)
+	return nil
+}
+
+// タグ作成API
+// POST /api/admin/tag
+func createTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	var req *CreateTagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tagUpdateLock.Lock()
+	defer tagUpdateLock.Unlock()
+
+	verr := &ValidationError{}
+	tagLock.RLock()
+	validateTagName(verr, "name", req.Name, 0)
+	validateTagParent(verr, req.ParentID, 0)
+	validateTagAliases(verr, req.Name, req.Aliases, 0)
+	tagLock.RUnlock()
+	if err := verr.Err(); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	rs, err := tx.ExecContext(ctx, "INSERT INTO tags (name, parent_id) VALUES (?, ?)", req.Name, req.ParentID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag: "+err.Error())
+	}
+	tagID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted tag id: "+err.Error())
+	}
+	if err := replaceTagAliases(ctx, tx, tagID, req.Aliases); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag aliases: "+err.Error())
+	}
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if err := reloadTagCache(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reload tags: "+err.Error())
+	}
+
+	tag, _ := getTagByID(tagID)
+	return c.JSON(http.StatusCreated, tag)
+}
+
+// タグの名前・親・別名の変更API
+// PATCH /api/admin/tag/:tag_id
+func updateTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	var req *UpdateTagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tagUpdateLock.Lock()
+	defer tagUpdateLock.Unlock()
+
+	tagLock.RLock()
+	tag, ok := TagMap[tagID]
+	if !ok {
+		tagLock.RUnlock()
+		return newNotFoundError("tag %d not found", tagID)
+	}
+
+	verr := &ValidationError{}
+	if req.Name != nil {
+		validateTagName(verr, "name", *req.Name, tagID)
+		tag.Name = *req.Name
+	}
+	if req.ParentID != nil {
+		validateTagParent(verr, *req.ParentID, tagID)
+		tag.ParentID = *req.ParentID
+	}
+	if req.Aliases != nil {
+		validateTagAliases(verr, tag.Name, *req.Aliases, tagID)
+	}
+	tagLock.RUnlock()
+	if err := verr.Err(); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE tags SET name = ?, parent_id = ? WHERE id = ?", tag.Name, tag.ParentID, tagID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag: "+err.Error())
+	}
+	if req.Aliases != nil {
+		if err := replaceTagAliases(ctx, tx, tagID, *req.Aliases); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag aliases: "+err.Error())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if err := reloadTagCache(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reload tags: "+err.Error())
+	}
+
+	tag, _ = getTagByID(tagID)
+	return c.JSON(http.StatusOK, tag)
+}
+
+// タグの廃止API
+// 既存の配信からは外さないが、新しい予約や編集では使えなくなる
+// DELETE /api/admin/tag/:tag_id
+func retireTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	tagUpdateLock.Lock()
+	defer tagUpdateLock.Unlock()
+
+	if _, ok := getTagByID(tagID); !ok {
+		return newNotFoundError("tag %d not found", tagID)
+	}
+	if _, err := dbConn.ExecContext(ctx, "UPDATE tags SET retired = 1 WHERE id = ?", tagID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to retire tag: "+err.Error())
+	}
+	if err := reloadTagCache(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reload tags: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
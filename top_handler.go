@@ -1,21 +1,26 @@
 package main
 
 import (
+	"cmp"
 	"database/sql"
 	"errors"
 	"net/http"
+	"slices"
 
 	"github.com/labstack/echo/v4"
 )
 
 type Tag struct {
-	ID   int64  `json:"id"`
-	Name string `json:"name"`
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	ParentID int64  `json:"parent_id,omitempty"`
 }
 
 type TagModel struct {
-	ID   int64  `db:"id"`
-	Name string `db:"name"`
+	ID       int64  `db:"id"`
+	Name     string `db:"name"`
+	ParentID int64  `db:"parent_id"`
+	Retired  bool   `db:"retired"`
 }
 
 type TagsResponse struct {
@@ -23,20 +28,18 @@ type TagsResponse struct {
 }
 
 func getTagHandler(c echo.Context) error {
-	ctx := c.Request().Context()
-
-	var tagModels []*TagModel
-	if err := dbConn.SelectContext(ctx, &tagModels, "SELECT * FROM tags"); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
-	}
-
-	tags := make([]*Tag, len(tagModels))
-	for i := range tagModels {
-		tags[i] = &Tag{
-			ID:   tagModels[i].ID,
-			Name: tagModels[i].Name,
+	tagLock.RLock()
+	tags := make([]*Tag, 0, len(TagMap))
+	for _, tag := range TagMap {
+		if _, retired := retiredTags[tag.ID]; !retired {
+			tags = append(tags, &Tag{ID: tag.ID, Name: tag.Name, ParentID: tag.ParentID})
 		}
 	}
+	tagLock.RUnlock()
+	slices.SortFunc(tags, func(a, b *Tag) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
 	return c.JSON(http.StatusOK, &TagsResponse{
 		Tags: tags,
 	})
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/sha256"
 	"database/sql"
@@ -15,13 +14,10 @@ import (
 	"strings"
 	"sync"
 	"time"
-	"unsafe"
 
 	"github.com/goccy/go-json"
-	"github.com/gofiber/fiber/v2"
 	"github.com/labstack/echo/v4"
 	"github.com/mojura/enkodo"
-	"github.com/valyala/fasthttp"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -57,6 +53,8 @@ type User struct {
 	Description string `json:"description,omitempty"`
 	Theme       Theme  `json:"theme,omitempty"`
 	IconHash    string `json:"icon_hash,omitempty"`
+	// フォロワー数
+	FollowerCount int64 `json:"follower_count"`
 }
 
 type Theme struct {
@@ -110,7 +108,8 @@ func (m UserModel) toUser() User {
 			ID:       m.ID,
 			DarkMode: m.DarkMode,
 		},
-		IconHash: m.IconHash,
+		IconHash:      m.IconHash,
+		FollowerCount: getFollowerCount(m.ID),
 	}
 	return user
 }
@@ -141,35 +140,6 @@ func getIconHandler(c echo.Context) error {
 	return c.Blob(http.StatusOK, "image/jpeg", image)
 }
 
-func UnsafeBytes(s string) []byte {
-	return unsafe.Slice(unsafe.StringData(s), len(s))
-}
-
-func getIconFiber(c *fiber.Ctx) error {
-
-	username := c.Params("username")
-	user, exists := getUserByName(username)
-	if !exists {
-		return c.Status(fasthttp.StatusNotFound).SendString("user not found: " + username)
-	}
-
-	noneMatch := c.Request().Header.Peek(fasthttp.HeaderIfNoneMatch)
-	if len(noneMatch) > 0 && bytes.Contains(noneMatch, UnsafeBytes(user.IconHash)) {
-		return c.SendStatus(fasthttp.StatusNotModified)
-	}
-
-	var image []byte
-	if err := dbConn.GetContext(c.Context(), &image, "SELECT image FROM icons WHERE user_id = ?", user.ID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return c.SendFile(fallbackImage)
-		} else {
-			return c.Status(fasthttp.StatusInternalServerError).SendString("failed to get user icon: " + err.Error())
-		}
-	}
-
-	return c.Status(fasthttp.StatusOK).Type("image/jpeg").Send(image)
-}
-
 func postIconHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
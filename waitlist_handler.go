@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+)
+
+// 予約枠が埋まっていた予約リクエスト
+// 枠が空いたら先に並んだものから予約する
+type ReservationWaitlistModel struct {
+	ID        int64  `db:"id"`
+	UserID    int64  `db:"user_id"`
+	Request   string `db:"request"`
+	StartAt   int64  `db:"start_at"`
+	EndAt     int64  `db:"end_at"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type ReservationWaitlistEntry struct {
+	ID        int64  `json:"id"`
+	Title     string `json:"title"`
+	StartAt   int64  `json:"start_at"`
+	EndAt     int64  `json:"end_at"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// 空き待ちの処理を直列にする
+var waitlistLock sync.Mutex
+
+// 開始時刻を過ぎた空き待ちは予約されずに消えるので、受け付けない
+func validateReservationWaitlist(req *ReserveLivestreamRequest, now time.Time) error {
+	verr := &ValidationError{}
+	if req.StartAt <= now.Unix() {
+		verr.Add("start_at", "can't wait for a livestream that has already started")
+	}
+	return verr.Err()
+}
+
+// 並んでいる間にタグが廃止されたり、コラボレーターがいなくなっていないかを確かめ直す
+func (w ReservationWaitlistModel) revalidate(req *ReserveLivestreamRequest) error {
+	verr := &ValidationError{}
+	validateTagIDs(verr, req.Tags)
+	validateCollaboratorIDs(verr, w.UserID, req.Collaborators)
+	return verr.Err()
+}
+
+func enqueueReservationWaitlist(ctx context.Context, userID int64, req *ReserveLivestreamRequest) (ReservationWaitlistEntry, error) {
+	rawReq, err := json.Marshal(req)
+	if err != nil {
+		return ReservationWaitlistEntry{}, err
+	}
+	waitlistModel := ReservationWaitlistModel{
+		UserID:    userID,
+		Request:   string(rawReq),
+		StartAt:   req.StartAt,
+		EndAt:     req.EndAt,
+		CreatedAt: time.Now().Unix(),
+	}
+	rs, err := dbConn.NamedExecContext(ctx, "INSERT INTO reservation_waitlist (user_id, request, start_at, end_at, created_at) VALUES (:user_id, :request, :start_at, :end_at, :created_at)", waitlistModel)
+	if err != nil {
+		return ReservationWaitlistEntry{}, err
+	}
+	waitlistID, err := rs.LastInsertId()
+	if err != nil {
+		return ReservationWaitlistEntry{}, err
+	}
+	return ReservationWaitlistEntry{
+		ID:        waitlistID,
+		Title:     req.Title,
+		StartAt:   waitlistModel.StartAt,
+		EndAt:     waitlistModel.EndAt,
+		CreatedAt: waitlistModel.CreatedAt,
+	}, nil
+}
+
+// 予約の空き待ち一覧API
+// GET /api/livestream/reservation/waitlist
+func getReservationWaitlistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	sess := getSession(c)
+	userID := sess.Values.UserID
+
+	var waitlistModels []ReservationWaitlistModel
+	if err := dbConn.SelectContext(ctx, &waitlistModels, "SELECT * FROM reservation_waitlist WHERE user_id = ? AND start_at > ? ORDER BY id", userID, time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation waitlist: "+err.Error())
+	}
+
+	entries := make([]ReservationWaitlistEntry, len(waitlistModels))
+	for i, w := range waitlistModels {
+		var req ReserveLivestreamRequest
+		if err := json.Unmarshal([]byte(w.Request), &req); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to decode reservation waitlist: "+err.Error())
+		}
+		entries[i] = ReservationWaitlistEntry{
+			ID:        w.ID,
+			Title:     req.Title,
+			StartAt:   w.StartAt,
+			EndAt:     w.EndAt,
+			CreatedAt: w.CreatedAt,
+		}
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
+
+// 予約枠が空いたときに呼ぶ
+// 空き待ちを古い順に見て、予約できるものを予約して配信者に通知する
+func processReservationWaitlist(ctx context.Context) {
+	waitlistLock.Lock()
+	defer waitlistLock.Unlock()
+
+	// 開始時刻を過ぎた空き待ちはもう予約できないので消す
+	now := time.Now().Unix()
+	if _, err := dbConn.ExecContext(ctx, "DELETE FROM reservation_waitlist WHERE start_at <= ?", now); err != nil {
+		log.Printf("failed to delete expired reservation waitlist: %+v", err)
+		return
+	}
+
+	var waitlistModels []ReservationWaitlistModel
+	if err := dbConn.SelectContext(ctx, &waitlistModels, "SELECT * FROM reservation_waitlist WHERE start_at > ? ORDER BY id", now); err != nil {
+		log.Printf("failed to get reservation waitlist: %+v", err)
+		return
+	}
+
+	for _, w := range waitlistModels {
+		var req ReserveLivestreamRequest
+		if err := json.Unmarshal([]byte(w.Request), &req); err != nil {
+			log.Printf("failed to decode reservation waitlist %d: %+v", w.ID, err)
+			continue
+		}
+		if err := w.revalidate(&req); err != nil {
+			// もう予約できないので外す
+			if _, err := dbConn.ExecContext(ctx, "DELETE FROM reservation_waitlist WHERE id = ?", w.ID); err != nil {
+				log.Printf("failed to delete reservation waitlist %d: %+v", w.ID, err)
+			}
+			log.Printf("dropped reservation waitlist %d: %v", w.ID, err)
+			continue
+		}
+		startIndex, endIndex := reservationConfig.slotIDRange(w.StartAt, w.EndAt)
+		if ok, _ := reservationSlots.Reserve(startIndex, endIndex); !ok {
+			continue
+		}
+		if err := bookReservationWaitlist(ctx, w, &req); err != nil {
+			reservationSlots.Release(startIndex, endIndex)
+			log.Printf("failed to book reservation waitlist %d: %+v", w.ID, err)
+		}
+	}
+}
+
+// 確保済みの予約枠で空き待ちを予約する
+func bookReservationWaitlist(ctx context.Context, w ReservationWaitlistModel, req *ReserveLivestreamRequest) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM reservation_waitlist WHERE id = ?", w.ID); err != nil {
+		return err
+	}
+
+	livestreamModel := &LivestreamModel{
+		UserID:       w.UserID,
+		Title:        req.Title,
+		Description:  req.Description,
+		PlaylistUrl:  req.PlaylistUrl,
+		ThumbnailUrl: req.ThumbnailUrl,
+		StartAt:      req.StartAt,
+		EndAt:        req.EndAt,
+		RawTags:      formatRawTags(req.Tags),
+	}
+	if err := insertLivestream(ctx, tx, livestreamModel, req.Tags, req.Collaborators); err != nil {
+		return err
+	}
+
+	if err := insertNotification(ctx, tx, w.UserID, livestreamModel.ID, "空き待ちしていた配信の予約が確定しました: "+req.Title); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	setLivestreamCache(*livestreamModel)
+	setCollaboratorIDs(livestreamModel.ID, req.Collaborators)
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	wsPingInterval = 30 * time.Second
+	wsWriteTimeout = 10 * time.Second
+	// 受信メッセージの上限
+	wsMaxMessageSize = 64 * 1024
+)
+
+// サーバから送るメッセージ
+// type は livecomment, reaction, livecomment_deleted, viewers, result, error, ping
+type WebSocketMessage struct {
+	Type  string `json:"type"`
+	ID    int64  `json:"id,omitempty"`
+	Ref   string `json:"ref,omitempty"`
+	Data  any    `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// クライアントから受け取るメッセージ
+// ref は応答の result / error にそのまま返す
+type WebSocketRequest struct {
+	Type      string `json:"type"`
+	Ref       string `json:"ref"`
+	Comment   string `json:"comment"`
+	Tip       int64  `json:"tip"`
+	EmojiName string `json:"emoji_name"`
+}
+
+func writeWebSocket(ws *websocket.Conn, msg WebSocketMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout)); err != nil {
+		return err
+	}
+	return websocket.Message.Send(ws, string(b))
+}
+
+func webSocketErrorMessage(err error) string {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return fmt.Sprint(he.Message)
+	}
+	return err.Error()
+}
+
+// 配信ごとのWebSocket API
+// 新しいライブコメント・リアクション・モデレーションによる削除・視聴者数を流し、
+// ライブコメントとリアクションの投稿も受け付ける
+// GET /api/livestream/:livestream_id/ws
+func livestreamWebSocketHandler(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	livestreamModel, exists := getLivestreamByID(int64(livestreamID))
+	if !exists {
+		return errLivestreamNotFound(int64(livestreamID))
+	}
+
+	sess := getSession(c)
+	userID := sess.Values.UserID
+
+	server := websocket.Server{
+		Handshake: checkWebSocketOrigin,
+		Handler: func(ws *websocket.Conn) {
+			serveLivestreamWebSocket(c.Request().Context(), ws, userID, livestreamModel.ID)
+		},
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// セッションは Cookie なので、他のオリジンのページから視聴者になりすまして接続させない
+// Origin を付けないブラウザ以外のクライアントは通す
+func checkWebSocketOrigin(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin != nil && !strings.EqualFold(origin.Host, req.Host) {
+		return fmt.Errorf("origin %s is not allowed", origin)
+	}
+	config.Origin = origin
+	return nil
+}
+
+func serveLivestreamWebSocket(ctx context.Context, ws *websocket.Conn, userID, livestreamID int64) {
+	defer ws.Close()
+	ws.MaxPayloadBytes = wsMaxMessageSize
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sub := livestreamEvents.Subscribe(livestreamID)
+	defer livestreamEvents.Unsubscribe(sub)
+	livestreamEvents.Join(livestreamID)
+	defer livestreamEvents.Leave(livestreamID)
+
+	// 投稿への応答は書き込みループから送る
+	replies := make(chan WebSocketMessage, livestreamEventBufferSize)
+	go func() {
+		defer cancel()
+		for {
+			var req WebSocketRequest
+			var raw string
+			if err := websocket.Message.Receive(ws, &raw); err != nil {
+				return
+			}
+			reply := WebSocketMessage{Type: "result"}
+			if err := json.Unmarshal([]byte(raw), &req); err != nil {
+				reply = WebSocketMessage{Type: "error", Error: "failed to decode the message as json"}
+			} else {
+				reply.Ref = req.Ref
+				data, err := handleWebSocketRequest(ctx, userID, livestreamID, &req)
+				if err != nil {
+					reply.Type = "error"
+					reply.Error = webSocketErrorMessage(err)
+				} else {
+					reply.Data = data
+				}
+			}
+			select {
+			case replies <- reply:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		var msg WebSocketMessage
+		select {
+		case <-ctx.Done():
+			return
+		case <-ping.C:
+			msg = WebSocketMessage{Type: "ping"}
+		case msg = <-replies:
+		case event, ok := <-sub.C:
+			if !ok {
+				// 受信が追いつかなかった。クライアントは再接続して取り直す
+				return
+			}
+			msg = WebSocketMessage{Type: event.Type, ID: event.ID, Data: event.Data}
+		}
+		if err := writeWebSocket(ws, msg); err != nil {
+			return
+		}
+	}
+}
+
+func handleWebSocketRequest(ctx context.Context, userID, livestreamID int64, req *WebSocketRequest) (any, error) {
+	switch req.Type {
+	case livestreamEventLivecomment:
+		return createLivecomment(ctx, userID, livestreamID, &PostLivecommentRequest{
+			Comment: req.Comment,
+			Tip:     req.Tip,
+		})
+	case livestreamEventReaction:
+		return createReaction(ctx, userID, livestreamID, &PostReactionRequest{
+			EmojiName: req.EmojiName,
+		})
+	default:
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "unknown message type: "+req.Type)
+	}
+}